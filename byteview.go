@@ -1,7 +1,11 @@
 package etcd
 
+import "time"
+
 type ByteView struct {
-	b []byte
+	b  []byte
+	e  time.Time // 过期时间，零值表示永不过期
+	nf bool      // 否定缓存条目，表示数据源中不存在这个 key
 }
 
 func (bv ByteView) Bytes() []byte {
@@ -18,6 +22,16 @@ func (bv ByteView) String() string {
 	return string(bv.b)
 }
 
+// Expire 返回值的过期时间，零值表示永不过期
+func (bv ByteView) Expire() time.Time {
+	return bv.e
+}
+
+// expired 判断值在 now 时是否已经过期
+func (bv ByteView) expired(now time.Time) bool {
+	return !bv.e.IsZero() && now.After(bv.e)
+}
+
 // 实现 Value 接口
 func (bv ByteView) Len() int {
 	return len(bv.b)
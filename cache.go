@@ -1,44 +1,163 @@
 package etcd
 
 import (
+	"hash/fnv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/1055373165/groupcache/logger"
+	"github.com/1055373165/groupcache/eviction"
 	"github.com/1055373165/groupcache/lru"
 )
 
-// cache 模块负责提供对lru模块的并发控制
+// cache 模块负责提供对淘汰策略（默认为 lru）的并发控制
+// lru 的 Get 会调整链表顺序，读操作也必须加互斥锁；为了避免一个 Group 的所有请求竞争同一把锁，
+// cache 按 key 的 hash 将数据分散到多个独立加锁的分片上，每个分片各自运行一个淘汰策略实例
+// 淘汰策略实现了 eviction.Evicter 时（内置的策略都实现了），所有分片共享同一份容量：
+// 每个分片都能容纳不超过总容量的条目，写入后总占用超过容量时，先按策略淘汰写入的分片，仍然超过时再轮流淘汰其他分片
+
+// defaultCacheShards 默认的分片数量
+const defaultCacheShards = 16
 
-// 给 lru 上层并发上一层锁
 type cache struct {
+	shards       []*cacheShard
+	maxCacheSize int64 // 所有分片的占用之和不超过 maxCacheSize
+	// shared 表示所有分片共享 maxCacheSize；否则每个分片的容量固定为 maxCacheSize/n，超过分片容量的条目不会被缓存
+	shared      bool
+	nbytes      atomic.Int64  // 所有分片占用的字节数之和
+	next        atomic.Uint32 // 轮流淘汰其他分片时的起始位置
+	stopJanitor chan struct{}
+}
+
+// 给淘汰策略上层并发上一层锁
+type cacheShard struct {
 	mu           sync.Mutex
-	lru          *lru.LRUCache
-	maxCacheSize int64 // 保证 lru 一定初始化
+	policy       eviction.Policy
+	newPolicy    eviction.Factory
+	maxCacheSize int64 // 保证 policy 一定初始化
+	nget, nhit   int64
+	nevict       int64 // 因容量不足被淘汰的条目数
+	nexpire      int64 // 因过期被删除的条目数
+	nbytes       int64 // 已经计入 cache.nbytes 的占用
+}
+
+// newShardedCache 创建一个有 n 个分片、总容量为 cacheSize 的 cache，cacheSize 为 0 表示不限制容量
+// 淘汰策略没有实现 eviction.Evicter 时，每个分片的容量为 cacheSize/n，cacheSize 小于 n 时减少分片数，保证每个分片至少有 1 字节的容量
+func newShardedCache(cacheSize int64, n int, newPolicy eviction.Factory) *cache {
+	if newPolicy == nil {
+		newPolicy = eviction.LRU
+	}
+	if n < 1 {
+		n = 1
+	}
+	c := &cache{maxCacheSize: cacheSize}
+	if cacheSize > 0 {
+		_, c.shared = newPolicy(cacheSize, nil).(eviction.Evicter)
+	}
+	shardSize := cacheSize
+	if !c.shared {
+		if cacheSize > 0 && cacheSize < int64(n) {
+			n = int(cacheSize)
+		}
+		shardSize = cacheSize / int64(n)
+	}
+	c.shards = make([]*cacheShard, n)
+	for i := range c.shards {
+		c.shards[i] = &cacheShard{
+			newPolicy:    newPolicy,
+			maxCacheSize: shardSize,
+		}
+	}
+	return c
+}
+
+// shard 返回 key 所在的分片
+func (c *cache) shard(key string) *cacheShard {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	return c.shards[keyHash(key)%uint32(len(c.shards))]
+}
+
+// keyHash 返回 key 的 FNV-1a 哈希，用于分片，也作为日志中 key 的替代
+func keyHash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// lazyInit 在第一次使用时初始化淘汰策略，调用方需持有 s.mu
+func (s *cacheShard) lazyInit() {
+	if s.policy == nil {
+		s.policy = s.newPolicy(s.maxCacheSize, func(_ string, _ lru.Value, reason lru.EvictReason) {
+			switch reason {
+			case lru.Evicted:
+				s.nevict++
+			case lru.Expired:
+				s.nexpire++
+			}
+		})
+	}
+}
+
+// account 将分片占用的变化计入 c.nbytes，分片的内容发生变化后调用，调用方需持有 s.mu
+func (c *cache) account(s *cacheShard) {
+	var n int64
+	if s.policy != nil {
+		n = s.policy.Bytes()
+	}
+	c.nbytes.Add(n - s.nbytes)
+	s.nbytes = n
 }
 
-func newCache(cacheSize int64) *cache {
-	return &cache{
-		maxCacheSize: cacheSize,
+// shrink 总占用超过容量时按策略淘汰 s 中的条目，至少保留一个条目（即刚写入的条目），调用方需持有 s.mu
+func (c *cache) shrink(s *cacheShard) {
+	for c.shared && c.nbytes.Load() > c.maxCacheSize && s.policy.Len() > 1 {
+		s.policy.(eviction.Evicter).Evict()
+		c.account(s)
+	}
+}
+
+// shrinkOthers 写入的分片不足以腾出空间时，从其他分片轮流各淘汰一个条目，直到总占用不超过容量
+// 每次只持有一个分片的锁，不会与其他写入互相等待
+func (c *cache) shrinkOthers(written *cacheShard) {
+	for c.shared && c.nbytes.Load() > c.maxCacheSize {
+		evicted := false
+		start := int(c.next.Add(1))
+		for i := range c.shards {
+			s := c.shards[(start+i)%len(c.shards)]
+			if s == written {
+				continue
+			}
+			s.mu.Lock()
+			if s.policy != nil && c.nbytes.Load() > c.maxCacheSize && s.policy.(eviction.Evicter).Evict() {
+				c.account(s)
+				evicted = true
+			}
+			s.mu.Unlock()
+		}
+		if !evicted {
+			return
+		}
 	}
 }
 
 // 并发控制
 func (c *cache) set(key string, value ByteView) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if c.lru == nil {
-		c.lru = lru.NewLRUCache(c.maxCacheSize, nil)
-	}
-	c.lru.Put(key, value)
+	c.putWithExpire(key, value, value.Expire())
 }
 func (c *cache) get(key string) (ByteView, bool) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if c.lru == nil {
-		c.lru = lru.NewLRUCache(c.maxCacheSize, nil)
-	}
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lazyInit()
+	s.nget++
+	// 已过期的条目会在 Get 时被删除
+	defer c.account(s)
 
-	if v, ok := c.lru.Get(key); ok { // Get 返回值是 Value 接口，直接类型断言
+	if v, ok := s.policy.Get(key); ok { // Get 返回值是 Value 接口，直接类型断言
+		s.nhit++
 		return v.(ByteView), true
 	} else {
 		return ByteView{}, false
@@ -46,11 +165,141 @@ func (c *cache) get(key string) (ByteView, bool) {
 }
 
 func (c *cache) put(key string, val ByteView) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if c.lru == nil {
-		c.lru = lru.NewLRUCache(c.maxCacheSize, nil)
+	c.putWithExpire(key, val, val.Expire())
+}
+
+// putWithExpire 写入条目，条目在 expire 时才会被淘汰策略清理，可以晚于 val 自身的过期时间
+func (c *cache) putWithExpire(key string, val ByteView, expire time.Time) {
+	c.putWithExpireIf(key, val, expire, nil)
+}
+
+// putWithExpireIf 与 putWithExpire 相同，但 valid 非空时只在持有分片锁时 valid 返回 true 才写入
+func (c *cache) putWithExpireIf(key string, val ByteView, expire time.Time, valid func() bool) {
+	s := c.shard(key)
+	s.mu.Lock()
+	if valid != nil && !valid() {
+		s.mu.Unlock()
+		return
+	}
+	s.lazyInit()
+	s.policy.PutWithExpire(key, val, expire)
+	c.account(s)
+	c.shrink(s)
+	s.mu.Unlock()
+	c.shrinkOthers(s)
+}
+
+// remove 删除 key 对应的条目
+func (c *cache) remove(key string) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.policy != nil {
+		s.policy.Remove(key)
+		c.account(s)
+	}
+}
+
+// removePrefix 删除所有以 prefix 开头的 key，返回删除的条目数
+func (c *cache) removePrefix(prefix string) int {
+	n := 0
+	for _, s := range c.shards {
+		s.mu.Lock()
+		if s.policy != nil {
+			for _, key := range s.policy.Keys() {
+				if strings.HasPrefix(key, prefix) && s.policy.Remove(key) {
+					n++
+				}
+			}
+			c.account(s)
+		}
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// clear 清空所有分片，下次访问时重新创建淘汰策略
+func (c *cache) clear() {
+	for _, s := range c.shards {
+		s.mu.Lock()
+		s.policy = nil
+		c.account(s)
+		s.mu.Unlock()
 	}
-	logger.Logger.Info("cache.put(key, val)")
-	c.lru.Put(key, val)
+}
+
+// startJanitor 启动后台清理协程，每隔 interval 清理一次已过期的条目
+// 过期条目即使不被访问也会被及时释放，不必等到容量不足时才被淘汰
+func (c *cache) startJanitor(interval time.Duration) {
+	c.stopJanitor = make(chan struct{})
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.removeExpired()
+			case <-stop:
+				return
+			}
+		}
+	}(c.stopJanitor)
+}
+
+// close 停止后台清理协程
+func (c *cache) close() {
+	if c.stopJanitor != nil {
+		close(c.stopJanitor)
+		c.stopJanitor = nil
+	}
+}
+
+// removeExpired 逐个分片清理过期条目，每次只锁住一个分片
+func (c *cache) removeExpired() {
+	for _, s := range c.shards {
+		s.mu.Lock()
+		if s.policy != nil {
+			s.policy.RemoveExpired()
+			c.account(s)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// stats 返回当前缓存的统计快照，由各个分片的统计累加而成
+func (c *cache) stats() CacheStats {
+	var stats CacheStats
+	for _, s := range c.shards {
+		s.mu.Lock()
+		stats.Gets += s.nget
+		stats.Hits += s.nhit
+		stats.Evictions += s.nevict
+		stats.Expires += s.nexpire
+		if s.policy != nil {
+			stats.Bytes += s.policy.Bytes()
+			stats.Items += int64(s.policy.Len())
+		}
+		s.mu.Unlock()
+	}
+	return stats
+}
+
+// CacheType 区分 Group 内部的两种缓存
+type CacheType int
+
+const (
+	// MainCache 缓存当前节点作为 owner 负责的 key
+	MainCache CacheType = iota + 1
+	// HotCache 缓存从远端节点取回的热点 key，避免热点 key 每次都跨网络请求
+	HotCache
+)
+
+// CacheStats 是某个缓存的统计信息
+type CacheStats struct {
+	Bytes     int64
+	Items     int64
+	Gets      int64
+	Hits      int64
+	Evictions int64
+	Expires   int64
 }
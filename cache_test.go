@@ -0,0 +1,82 @@
+package etcd
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/1055373165/groupcache/eviction"
+)
+
+func TestCacheShardBudget(t *testing.T) {
+	c := newShardedCache(1<<10, 8, nil)
+	for i := 0; i < 1000; i++ {
+		c.put(fmt.Sprintf("key%d", i), ByteView{b: make([]byte, 16)})
+	}
+	stats := c.stats()
+	if stats.Bytes > 1<<10 {
+		t.Fatalf("expect cache bytes no more than %d, but got %d", 1<<10, stats.Bytes)
+	}
+	if stats.Evictions == 0 {
+		t.Fatal("expect evictions when cache is over budget")
+	}
+
+	if got := c.nbytes.Load(); got != stats.Bytes {
+		t.Fatalf("expect shared byte count %d, but got %d", stats.Bytes, got)
+	}
+
+	// 淘汰策略不支持主动淘汰时退回固定的分片容量，容量小于分片数时减少分片
+	if c := newShardedCache(4, 16, noEvictPolicy); c.shared || len(c.shards) != 4 || c.shards[0].maxCacheSize != 1 {
+		t.Fatalf("expect 4 shards with 1 byte each, but got %d shards", len(c.shards))
+	}
+}
+
+// noEvictPolicy 创建不支持 eviction.Evicter 的 LRU
+func noEvictPolicy(maxBytes int64, onEvicted eviction.OnEvicted) eviction.Policy {
+	return struct{ eviction.Policy }{eviction.LRU(maxBytes, onEvicted)}
+}
+
+func TestCacheEntryLimit(t *testing.T) {
+	// 所有分片共享 8KB 的容量，超过 1/8 容量的条目同样可以被缓存
+	c := newShardedCache(8<<10, 8, nil)
+	for i := 0; i < 4; i++ {
+		c.put(fmt.Sprintf("small%d", i), ByteView{b: make([]byte, 1000)})
+	}
+	c.put("large", ByteView{b: make([]byte, 6<<10)})
+	if _, ok := c.get("large"); !ok {
+		t.Fatal("expect entry over 1/n of the budget to be cached")
+	}
+	if got := c.stats().Bytes; got > 8<<10 {
+		t.Fatalf("expect cache bytes no more than %d, but got %d", 8<<10, got)
+	}
+
+	// 固定分片容量时，超过分片容量的条目不会被缓存
+	c = newShardedCache(8<<10, 8, noEvictPolicy)
+	c.put("large", ByteView{b: make([]byte, 2<<10)})
+	if _, ok := c.get("large"); ok {
+		t.Fatal("expect entry over shard budget not to be cached")
+	}
+}
+
+// BenchmarkCacheGetParallel 对比单把锁与分片锁在并发读下的表现：
+// go test -run xxx -bench CacheGetParallel -cpu 1,4,8
+func BenchmarkCacheGetParallel(b *testing.B) {
+	const keys = 1024
+	for _, shards := range []int{1, defaultCacheShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			c := newShardedCache(0, shards, nil)
+			names := make([]string, keys)
+			for i := range names {
+				names[i] = fmt.Sprintf("key%d", i)
+				c.put(names[i], ByteView{b: []byte("value")})
+			}
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					c.get(names[i%keys])
+					i++
+				}
+			})
+		})
+	}
+}
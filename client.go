@@ -2,55 +2,335 @@ package etcd
 
 import (
 	"context"
-
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"sync/atomic"
 	"time"
 
 	rd "github.com/1055373165/groupcache/server_registry_discover"
 
 	pb "github.com/1055373165/groupcache/groupcachepb"
+	"github.com/1055373165/groupcache/logger"
 
 	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// defaultFetchTimeout 调用方的 ctx 没有设置截止时间时，Fetch 使用的默认超时时间
+	defaultFetchTimeout = 10 * time.Second
+	// 连接断开后重连的最大退避时间
+	maxReconnectBackoff = 5 * time.Second
+	// 连续失败达到 breakerThreshold 次后熔断，breakerCooldown 内 Pick 不再选择该 peer
+	// 冷却结束后进入半开状态：请求重新发往该 peer，成功一次即恢复，再失败一次立即重新熔断
+	breakerThreshold = 5
+	breakerCooldown  = 10 * time.Second
 )
 
 // client 模块实现了 groupcache 访问其他远程节点从而获取缓存的能力
+// 每个 client 持有一条到 peer 的长连接，所有 Fetch 复用这条连接，gRPC 负责断线重连
 type client struct {
-	name string // 服务名称 gcache/ip:addr
+	name     string // 服务名称 gcache/ip:addr
+	conn     *grpc.ClientConn
+	grpcCli  pb.GroupCacheClient
+	failures int64 // 连续失败的请求次数，远端节点正常返回（包括业务错误）一次即清零
+	inflight int64 // 正在进行中的 Fetch 数量，用于有界负载的一致性哈希
+	// openUntil 是熔断的截止时间（unix 纳秒），0 表示没有熔断
+	openUntil int64
+	log       logger.Interface // 携带 peer 字段，由 Server 设置
+	// fetchTimeout 是调用方的 ctx 没有截止时间时请求使用的超时时间
+	fetchTimeout time.Duration
+	// maxValueBytes 是从 peer 接收的单个 value 的大小上限，0 表示不限制，由 Server 按 MaxValueBytes 设置
+	maxValueBytes int64
 }
 
 // Fetch 从 remote peer 获取对应的缓存值
-func (c *client) Fetch(group string, key string) ([]byte, error) {
-	// 创建一个 etcd client
-	cli, err := clientv3.New(rd.DefaultEtcdConfig)
+// ctx 的截止时间由 gRPC 放入请求的元数据（grpc-timeout）中，远端节点处理请求时会继续沿用
+func (c *client) Fetch(ctx context.Context, group string, key string) (ByteView, error) {
+	atomic.AddInt64(&c.inflight, 1)
+	defer atomic.AddInt64(&c.inflight, -1)
+
+	// 调用方没有设置截止时间时使用默认超时，避免请求无限期阻塞
+	ctx, cancel, own := c.withTimeout(ctx)
+	defer cancel()
+
+	ctx, span := startSpan(ctx, "groupcache.client.Fetch", trace.SpanKindClient,
+		attrGroup.String(group), keyAttr(key), attrPeer.String(c.name))
+	ctx = injectTrace(ctx)
+
+	// 使用 GetStream 分段接收，大 value 不受 gRPC 单条消息大小的限制
+	start := time.Now()
+	view, err := c.fetchStream(ctx, group, key)
+	observeRPC(c.name, "GetStream", start, err)
+	err = c.observe(err, own)
+	endSpan(span, err)
+	if errors.Is(err, ErrNotFound) {
+		return ByteView{}, ErrNotFound
+	}
 	if err != nil {
-		return nil, err
+		return ByteView{}, fmt.Errorf("could not get %s/%s from peer %s: %w", group, key, c.name, err)
 	}
-	defer cli.Close()
+	return view, nil
+}
 
-	// 发现服务，取得与服务的链接
-	conn, err := rd.EtcdDial(cli, c.name)
+// maxRecvMsgSize 返回单个响应的大小上限，与 Server 按 MaxValueBytes 设置的 MaxRecvMsgSize 一致
+// GetMany 的响应除了 value 之外还包含所有的 key 和错误信息，不能依赖 gRPC 默认 4MB 的限制
+func (c *client) maxRecvMsgSize() int {
+	if c.maxValueBytes <= 0 || c.maxValueBytes > math.MaxInt32-streamChunkSize {
+		return math.MaxInt32
+	}
+	return int(c.maxValueBytes) + streamChunkSize
+}
+
+// withTimeout 在调用方的 ctx 没有截止时间时设置 fetchTimeout
+// own 表示截止时间是否由 client 设置，只有这种情况下的超时才说明远端节点响应过慢
+func (c *client) withTimeout(ctx context.Context) (_ context.Context, _ context.CancelFunc, own bool) {
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}, false
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.fetchTimeout)
+	return ctx, cancel, true
+}
+
+// observe 将 gRPC 错误还原成对应类型的错误，并根据错误类型维护连续失败次数
+// 调用方取消请求或者自己的截止时间过短导致的超时既不计入失败次数，也不清零：
+// 这种情况下无法判断远端节点是否正常，只有收到远端节点的响应才说明它恢复了
+func (c *client) observe(err error, ownDeadline bool) error {
+	err = fromStatus(err)
+	switch {
+	case err != nil && (isPeerFailure(err) || ownDeadline && errors.Is(err, context.DeadlineExceeded)):
+		if atomic.AddInt64(&c.failures, 1) >= breakerThreshold {
+			atomic.StoreInt64(&c.openUntil, time.Now().Add(breakerCooldown).UnixNano())
+			c.log.Warn("circuit breaker open", "failures", atomic.LoadInt64(&c.failures), "err", err)
+		}
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+	default:
+		atomic.StoreInt64(&c.failures, 0)
+		atomic.StoreInt64(&c.openUntil, 0)
+	}
+	return err
+}
+
+// fetchStream 接收 GetStream 返回的所有分段并重新拼接成完整的值
+func (c *client) fetchStream(ctx context.Context, group string, key string) (ByteView, error) {
+	stream, err := c.grpcCli.GetStream(ctx, &pb.GetRequest{
+		Group: group,
+		Key:   key,
+	})
 	if err != nil {
-		return nil, err
+		return ByteView{}, err
+	}
+
+	first, err := stream.Recv()
+	if err != nil {
+		return ByteView{}, err
+	}
+	if first.NotFound {
+		return ByteView{}, ErrNotFound
+	}
+	// 分配内存之前先校验 peer 声明的大小，避免异常的 peer 让本节点 panic 或耗尽内存
+	if first.Size < 0 || int64(len(first.Data)) > first.Size {
+		return ByteView{}, fmt.Errorf("invalid stream size %d", first.Size)
+	}
+	if c.maxValueBytes > 0 && first.Size > c.maxValueBytes {
+		return ByteView{}, fmt.Errorf("%w: %s/%s is %d bytes, exceeds limit %d", ErrValueTooLarge, group, key, first.Size, c.maxValueBytes)
+	}
+	view := ByteView{}
+	if first.Expire != 0 {
+		view.e = time.Unix(0, first.Expire)
+	}
+	// 只有一段时直接使用，避免多余的拷贝
+	if int64(len(first.Data)) == first.Size {
+		view.b = first.Data
+		return view, nil
+	}
+
+	buf := make([]byte, 0, first.Size)
+	buf = append(buf, first.Data...)
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return ByteView{}, err
+		}
+		if int64(len(buf)+len(chunk.Data)) > first.Size {
+			return ByteView{}, fmt.Errorf("stream exceeds declared size %d", first.Size)
+		}
+		buf = append(buf, chunk.Data...)
+	}
+	if int64(len(buf)) != first.Size {
+		return ByteView{}, fmt.Errorf("stream truncated, got %d of %d bytes", len(buf), first.Size)
+	}
+	view.b = buf
+	return view, nil
+}
+
+// FetchMany 通过一次 GetMany 请求从 remote peer 获取多个 key
+// 响应中被标记为 truncated 的大 value 随后逐个通过 GetStream 获取，批量响应不会超过 gRPC 的消息大小限制
+func (c *client) FetchMany(ctx context.Context, group string, keys []string) (map[string]Result, error) {
+	atomic.AddInt64(&c.inflight, 1)
+	defer atomic.AddInt64(&c.inflight, -1)
+
+	ctx, cancel, own := c.withTimeout(ctx)
+	defer cancel()
+
+	ctx, span := startSpan(ctx, "groupcache.client.FetchMany", trace.SpanKindClient,
+		attrGroup.String(group), attrPeer.String(c.name), attribute.Int("groupcache.keys", len(keys)))
+	ctx = injectTrace(ctx)
+
+	start := time.Now()
+	resp, err := c.grpcCli.GetMany(ctx, &pb.GetManyRequest{
+		Group: group,
+		Keys:  keys,
+	}, grpc.MaxCallRecvMsgSize(c.maxRecvMsgSize()))
+	observeRPC(c.name, "GetMany", start, err)
+	err = c.observe(err, own)
+	endSpan(span, err)
+	if err != nil {
+		return nil, fmt.Errorf("could not get %d keys of %s from peer %s: %w", len(keys), group, c.name, err)
+	}
+
+	results := make(map[string]Result, len(resp.Items))
+	var truncated []string
+	for _, item := range resp.Items {
+		if item.Truncated {
+			truncated = append(truncated, item.Key)
+			continue
+		}
+		if item.NotFound {
+			results[item.Key] = Result{Err: ErrNotFound}
+			continue
+		}
+		if item.Error != "" {
+			results[item.Key] = Result{Err: fromStatus(status.Error(codes.Code(item.Code), item.Error))}
+			continue
+		}
+		view := ByteView{b: item.Value}
+		if item.Expire != 0 {
+			view.e = time.Unix(0, item.Expire)
+		}
+		results[item.Key] = Result{Value: view}
+	}
+	// 超出批量响应大小上限的 value 逐个通过 GetStream 获取
+	for _, key := range truncated {
+		view, err := c.Fetch(ctx, group, key)
+		results[key] = Result{Value: view, Err: err}
 	}
-	defer conn.Close()
+	return results, nil
+}
 
-	grpcClient := pb.NewGroupCacheClient(conn)
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// Remove 通知 remote peer 删除本地缓存中的 key
+func (c *client) Remove(ctx context.Context, group string, key string) error {
+	ctx, cancel, own := c.withTimeout(ctx)
 	defer cancel()
-	// 使用带有超时自动取消的上下文和指定请求调用客户端的 Get 方法发起 rpc 请求调用
-	resp, err := grpcClient.Get(ctx, &pb.GetRequest{
+
+	ctx = injectTrace(ctx)
+	start := time.Now()
+	_, err := c.grpcCli.Delete(ctx, &pb.DeleteRequest{
 		Group: group,
 		Key:   key,
 	})
-	if err != nil {
-		return nil, fmt.Errorf("could not get %s/%s from perr %s", group, key, c.name)
+	observeRPC(c.name, "Delete", start, err)
+	if err := c.observe(err, own); err != nil {
+		return fmt.Errorf("could not delete %s/%s from peer %s: %w", group, key, c.name, err)
 	}
+	return nil
+}
+
+// Set 将值写入 remote peer 的 mainCache
+func (c *client) Set(ctx context.Context, group string, key string, value ByteView) error {
+	ctx, cancel, own := c.withTimeout(ctx)
+	defer cancel()
 
-	return resp.Value, nil
+	req := &pb.SetRequest{
+		Group: group,
+		Key:   key,
+		Value: value.b,
+	}
+	if expire := value.Expire(); !expire.IsZero() {
+		req.Expire = expire.UnixNano()
+	}
+	ctx = injectTrace(ctx)
+	start := time.Now()
+	_, err := c.grpcCli.Set(ctx, req)
+	observeRPC(c.name, "Set", start, err)
+	if err := c.observe(err, own); err != nil {
+		return fmt.Errorf("could not set %s/%s to peer %s: %w", group, key, c.name, err)
+	}
+	return nil
+}
+
+// healthy 根据连接状态判断 peer 当前是否可用
+// 连接处于 TransientFailure 时 gRPC 正在退避重连，此时请求会直接失败
+func (c *client) healthy() bool {
+	switch c.conn.GetState() {
+	case connectivity.TransientFailure, connectivity.Shutdown:
+		return false
+	default:
+		return true
+	}
+}
+
+// available 判断 Pick 是否可以选择这个 peer：连接可用且没有处于熔断状态
+func (c *client) available() bool {
+	return c.healthy() && time.Now().UnixNano() >= atomic.LoadInt64(&c.openUntil)
 }
 
-func NewClient(service string) *client {
-	return &client{name: service}
+// peerName 返回 Fetcher 对应的服务名称，用于日志中的 peer 字段
+func peerName(f Fetcher) string {
+	if c, ok := f.(*client); ok {
+		return c.name
+	}
+	return fmt.Sprintf("%T", f)
+}
+
+// close 关闭到 peer 的长连接
+func (c *client) close() error {
+	return c.conn.Close()
+}
+
+// NewClient 通过 etcd 发现服务并建立到 peer 的长连接
+// 连接是非阻塞建立的，断开后按指数退避自动重连
+func NewClient(service string, etcdCli *clientv3.Client) (*client, error) {
+	conn, err := rd.EtcdDial(context.Background(), etcdCli, service,
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff: backoff.Config{
+				BaseDelay:  100 * time.Millisecond,
+				Multiplier: backoff.DefaultConfig.Multiplier,
+				Jitter:     backoff.DefaultConfig.Jitter,
+				MaxDelay:   maxReconnectBackoff,
+			},
+			MinConnectTimeout: 2 * time.Second,
+		}),
+		// 定期发送心跳，尽早发现已经失效的连接
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                30 * time.Second,
+			Timeout:             10 * time.Second,
+			PermitWithoutStream: true,
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &client{
+		name:          service,
+		conn:          conn,
+		grpcCli:       pb.NewGroupCacheClient(conn),
+		log:           logger.Nop(),
+		fetchTimeout:  defaultFetchTimeout,
+		maxValueBytes: defaultMaxValueBytes,
+	}, nil
 }
 
 // 测试 client 是否实现了 Fetcher 接口
@@ -1,17 +1,17 @@
 package consistenthash
 
 import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
 	"testing"
 
-	"github.com/1055373165/groupcache/conf"
-	"github.com/1055373165/groupcache/db"
 	"github.com/1055373165/groupcache/logger"
 )
 
 func init() {
-	conf.Init()
 	logger.Init()
-	db.Init()
 }
 
 func TestConsistentHash(t *testing.T) {
@@ -24,8 +24,9 @@ func TestConsistentHash(t *testing.T) {
 	// 4 14 24
 	// 2 12 22
 	ch.AddTruthNode("2", "4")
-	for _, virtualhash := range ch.virtualNodes {
-		logger.Logger.Infof("虚拟节点 hash 值：%d, 对应的真实节点为：%s", virtualhash, ch.hashMap[virtualhash])
+	r := ch.ring.Load()
+	for _, virtualhash := range r.virtualNodes {
+		logger.Logger.Infof("虚拟节点 hash 值：%d, 对应的真实节点为：%s", virtualhash, r.hashMap[virtualhash])
 	}
 	// node2 值：2322626082 值：4252452532
 	// node4 值：2871910706 值：3693793700
@@ -40,3 +41,149 @@ func TestConsistentHash(t *testing.T) {
 		t.Fatal("GetTruthNode 错误")
 	}
 }
+
+func TestConsistentHashIncremental(t *testing.T) {
+	ch := NewConsistentHash(50, nil)
+	ch.AddTruthNode("a:1", "b:2")
+	ch.AddTruthNode("c:3", "a:1") // a:1 已经在环上，应被忽略
+
+	if members, expect := ch.Members(), []string{"a:1", "b:2", "c:3"}; !reflect.DeepEqual(members, expect) {
+		t.Fatalf("expect members %v, but got %v", expect, members)
+	}
+	r := ch.ring.Load()
+	if !sort.IntsAreSorted(r.virtualNodes) || len(r.virtualNodes) != len(r.hashMap) {
+		t.Fatalf("ring is broken after incremental add: %d virtual nodes, %d hash entries", len(r.virtualNodes), len(r.hashMap))
+	}
+
+	// 记录移除 b:2 之前的映射，其他节点负责的 key 不应该发生迁移
+	before := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		before[key] = ch.GetTruthNode(key)
+	}
+	ch.RemovePeer("b:2")
+	r = ch.ring.Load()
+	if !sort.IntsAreSorted(r.virtualNodes) || len(r.virtualNodes) != 100 {
+		t.Fatalf("expect 100 sorted virtual nodes after remove, but got %d", len(r.virtualNodes))
+	}
+	for key, node := range before {
+		got := ch.GetTruthNode(key)
+		if got == "b:2" || (node != "b:2" && got != node) {
+			t.Fatalf("key %s moved from %s to %s", key, node, got)
+		}
+	}
+	if members, expect := ch.Members(), []string{"a:1", "c:3"}; !reflect.DeepEqual(members, expect) {
+		t.Fatalf("expect members %v, but got %v", expect, members)
+	}
+}
+
+func TestConsistentHashConcurrent(t *testing.T) {
+	ch := NewConsistentHash(10, nil)
+	ch.AddTruthNode("a:1")
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if ch.GetTruthNode("key") == "" {
+					t.Error("ring should never be empty")
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		node := fmt.Sprintf("n:%d", i)
+		ch.AddTruthNode(node)
+		ch.RemovePeer(node)
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestConsistentHashWeighted(t *testing.T) {
+	ch := NewConsistentHash(50, nil)
+	ch.AddWeightedTruthNode(map[string]int{"small:1": 1, "large:2": 3})
+
+	if len(ch.ring.Load().virtualNodes) != 200 {
+		t.Fatalf("expect 200 virtual nodes, but got %d", len(ch.ring.Load().virtualNodes))
+	}
+	if ch.Weight("large:2") != 3 || ch.Weight("small:1") != 1 || ch.Weight("none:3") != 0 {
+		t.Fatalf("unexpected weights: large=%d small=%d", ch.Weight("large:2"), ch.Weight("small:1"))
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		counts[ch.GetTruthNode(fmt.Sprintf("key%d", i))]++
+	}
+	// 权重为 3 的节点应该承担明显更多的 key
+	if counts["large:2"] < 2*counts["small:1"] {
+		t.Fatalf("expect large node to own about 3x keys of small node, got %v", counts)
+	}
+}
+
+func TestConsistentHashBounded(t *testing.T) {
+	ch := NewConsistentHash(50, nil)
+	ch.AddTruthNode("a:1", "b:2", "c:3")
+
+	key := "hotkey"
+	owner := ch.GetTruthNode(key)
+	// 没有负载时与普通查找结果一致
+	if got := ch.GetTruthNodeBounded(key, 1.25, nil); got != owner {
+		t.Fatalf("expect %s without load, but got %s", owner, got)
+	}
+	// owner 的负载远超平均值，应该顺时针跳到下一个节点
+	loads := map[string]int64{owner: 10}
+	got := ch.GetTruthNodeBounded(key, 1.25, loads)
+	if got == owner || got == "" {
+		t.Fatalf("expect key to skip overloaded owner %s, but got %s", owner, got)
+	}
+	// loadFactor <= 1 时不启用有界负载
+	if got := ch.GetTruthNodeBounded(key, 1, loads); got != owner {
+		t.Fatalf("expect %s when bounded load is disabled, but got %s", owner, got)
+	}
+}
+
+func TestConsistentHashCollision(t *testing.T) {
+	// 只取最后一位数字作为 hash 值，所有节点的第 i 个虚拟节点都落在同一个位置
+	hash := func(data []byte) uint32 { return uint32(data[len(data)-1] - '0') }
+	owners := func(ch *ConsistentHash) map[int]string {
+		r := ch.ring.Load()
+		if !sort.IntsAreSorted(r.virtualNodes) || len(r.virtualNodes) != len(r.hashMap) {
+			t.Fatalf("ring is broken: %d virtual nodes, %d hash entries", len(r.virtualNodes), len(r.hashMap))
+		}
+		return r.hashMap
+	}
+
+	// 冲突的位置归名称最小的节点，与加入顺序无关
+	ab := NewConsistentHash(2, hash)
+	ab.AddTruthNode("a")
+	ab.AddTruthNode("b")
+	ba := NewConsistentHash(2, hash)
+	ba.AddTruthNode("b")
+	ba.AddTruthNode("a")
+	if expect := map[int]string{0: "a", 1: "a"}; !reflect.DeepEqual(owners(ab), expect) || !reflect.DeepEqual(owners(ba), expect) {
+		t.Fatalf("expect %v, but got %v and %v", expect, owners(ab), owners(ba))
+	}
+
+	// 移除之后冲突的位置交给剩下的节点
+	ab.RemovePeer("a")
+	if expect := map[int]string{0: "b", 1: "b"}; !reflect.DeepEqual(owners(ab), expect) {
+		t.Fatalf("expect %v after remove, but got %v", expect, owners(ab))
+	}
+	if node := ab.GetTruthNode("key0"); node != "b" {
+		t.Fatalf("expect key0 on b, but got %q", node)
+	}
+	ab.RemovePeer("b")
+	if len(owners(ab)) != 0 {
+		t.Fatalf("expect empty ring, but got %v", owners(ab))
+	}
+}
@@ -1,19 +1,31 @@
 package consistenthash
 
 import (
-	"github.com/1055373165/groupcache/logger"
 	"hash/crc32"
+	"math"
 	"sort"
 	"strconv"
+	"sync"
+	"sync/atomic"
 )
 
 type Hash func(data []byte) uint32
 
+// ConsistentHash 的哈希环采用写时复制：
+// 写操作（AddTruthNode/RemovePeer）在锁内复制一份新的环并原子替换，读操作（GetTruthNode/Members）无锁读取当前快照，
+// 因此成员变更期间的查询不会被阻塞
 type ConsistentHash struct {
-	hash         Hash
-	replicas     int
-	virtualNodes []int
-	hashMap      map[int]string
+	hash     Hash
+	replicas int
+	mu       sync.Mutex // 串行化写操作
+	ring     atomic.Pointer[ring]
+}
+
+// ring 是哈希环的一份不可变快照
+type ring struct {
+	virtualNodes []int          // 有序的虚拟节点 hash 值
+	hashMap      map[int]string // 虚拟节点 hash 值 -> 真实节点
+	nodes        map[string]int // 真实节点 -> 权重
 }
 
 func NewConsistentHash(replicas int, hash Hash) *ConsistentHash {
@@ -21,61 +33,245 @@ func NewConsistentHash(replicas int, hash Hash) *ConsistentHash {
 		hash = crc32.ChecksumIEEE
 	}
 
-	return &ConsistentHash{
+	ch := &ConsistentHash{
 		hash:     hash,
 		replicas: replicas,
-		hashMap:  map[int]string{},
 	}
+	ch.ring.Store(&ring{
+		hashMap: map[int]string{},
+		nodes:   map[string]int{},
+	})
+	return ch
+}
+
+// clone 复制一份可修改的环，用于写时复制
+func (r *ring) clone() *ring {
+	nr := &ring{
+		virtualNodes: make([]int, len(r.virtualNodes)),
+		hashMap:      make(map[int]string, len(r.hashMap)),
+		nodes:        make(map[string]int, len(r.nodes)),
+	}
+	copy(nr.virtualNodes, r.virtualNodes)
+	for k, v := range r.hashMap {
+		nr.hashMap[k] = v
+	}
+	for k, v := range r.nodes {
+		nr.nodes[k] = v
+	}
+	return nr
 }
 
+// AddTruthNode 将真实节点以权重 1 加入哈希环，已经在环上的节点会被忽略
+// 新节点的虚拟节点排序后与原有的有序虚拟节点归并，不需要重建整个环
+// 若虚拟节点的 hash 值与其他节点冲突，这个位置归名称最小的节点所有，与加入顺序无关，各节点因此得到一致的环
 func (ch *ConsistentHash) AddTruthNode(nodes ...string) {
+	weights := make(map[string]int, len(nodes))
+	for _, node := range nodes {
+		weights[node] = 1
+	}
+	ch.AddWeightedTruthNode(weights)
+}
+
+// AddWeightedTruthNode 按权重将真实节点加入哈希环，节点的虚拟节点数为 replicas * weight
+// 权重小于 1 时按 1 处理；已经在环上的节点会被忽略，需要调整权重时先 RemovePeer 再重新加入
+func (ch *ConsistentHash) AddWeightedTruthNode(weights map[string]int) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	nodes := make([]string, 0, len(weights))
+	for node := range weights {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	r := ch.ring.Load().clone()
+	var added []int
 	for _, node := range nodes {
-		for i := 0; i < ch.replicas; i++ {
+		if _, ok := r.nodes[node]; ok {
+			continue
+		}
+		weight := weights[node]
+		if weight < 1 {
+			weight = 1
+		}
+		r.nodes[node] = weight
+		for i := 0; i < ch.replicas*weight; i++ {
 			hash := int(ch.hash([]byte(node + strconv.Itoa(i))))
-			ch.virtualNodes = append(ch.virtualNodes, hash)
-			ch.hashMap[hash] = node
+			if owner, ok := r.hashMap[hash]; ok {
+				// 位置已经在有序切片中，只需要交给名称更小的节点
+				if node < owner {
+					r.hashMap[hash] = node
+				}
+				continue
+			}
+			r.hashMap[hash] = node
+			added = append(added, hash)
+		}
+	}
+	if len(added) == 0 {
+		ch.ring.Store(r)
+		return
+	}
+	sort.Ints(added)
+	r.virtualNodes = mergeSorted(r.virtualNodes, added)
+	ch.ring.Store(r)
+}
+
+// mergeSorted 归并两个有序切片
+func mergeSorted(a, b []int) []int {
+	merged := make([]int, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i] <= b[j] {
+			merged = append(merged, a[i])
+			i++
+		} else {
+			merged = append(merged, b[j])
+			j++
 		}
 	}
-	sort.Ints(ch.virtualNodes)
+	merged = append(merged, a[i:]...)
+	return append(merged, b[j:]...)
 }
 
 // 选择真实节点
 func (ch *ConsistentHash) GetTruthNode(key string) string {
-	if len(ch.virtualNodes) == 0 {
+	r := ch.ring.Load()
+	if len(r.virtualNodes) == 0 {
 		return ""
 	}
 
 	hash := int(ch.hash([]byte(key)))
-	idx := sort.Search(len(ch.virtualNodes), func(i int) bool {
-		return ch.virtualNodes[i] >= hash
+	idx := sort.Search(len(r.virtualNodes), func(i int) bool {
+		return r.virtualNodes[i] >= hash
 	})
-	logger.Logger.Infof("计算出 key 的 hash: %d, 顺时针选择的虚拟节点下标 idx: %d", hash, idx)
-	logger.Logger.Infof("2322626082 2871910706 3693793700 4252452532")
-	logger.Logger.Infof("选择的真实节点：%s", ch.hashMap[ch.virtualNodes[idx%len(ch.virtualNodes)]])
-	return ch.hashMap[ch.virtualNodes[idx%len(ch.virtualNodes)]]
+	return r.hashMap[r.virtualNodes[idx%len(r.virtualNodes)]]
 }
 
-func (ch *ConsistentHash) RemovePeer(peer string) {
-	// 将真实节点从 hash 环中删除
-	logger.Logger.Warn("peer:", peer)
-	virtualHash := []int{}
-	for key, v := range ch.hashMap {
-		logger.Logger.Warn("peers:", v)
-		if v == peer {
-			delete(ch.hashMap, key)
-			virtualHash = append(virtualHash, key)
+// GetTruthNodeBounded 实现了有界负载的一致性哈希（consistent hashing with bounded loads）
+// loads 是各个真实节点当前正在处理的请求数，每个节点的容量上限为 ceil(loadFactor * (总负载+1) * 节点权重 / 总权重)，
+// 即不超过平均负载的 loadFactor 倍；从 key 在环上的位置顺时针查找，跳过已达到上限的节点
+// loadFactor 需大于 1，否则退化为普通的 GetTruthNode；所有节点都达到上限时返回 key 原本对应的节点
+func (ch *ConsistentHash) GetTruthNodeBounded(key string, loadFactor float64, loads map[string]int64) string {
+	r := ch.ring.Load()
+	if len(r.virtualNodes) == 0 {
+		return ""
+	}
+	if loadFactor <= 1 {
+		return ch.GetTruthNode(key)
+	}
+
+	var total int64
+	var totalWeight int
+	for node, weight := range r.nodes {
+		total += loads[node]
+		totalWeight += weight
+	}
+
+	hash := int(ch.hash([]byte(key)))
+	idx := sort.Search(len(r.virtualNodes), func(i int) bool {
+		return r.virtualNodes[i] >= hash
+	})
+	first := r.hashMap[r.virtualNodes[idx%len(r.virtualNodes)]]
+	checked := make(map[string]struct{}, len(r.nodes))
+	for i := 0; i < len(r.virtualNodes) && len(checked) < len(r.nodes); i++ {
+		node := r.hashMap[r.virtualNodes[(idx+i)%len(r.virtualNodes)]]
+		if _, ok := checked[node]; ok {
+			continue
 		}
+		checked[node] = struct{}{}
+		limit := math.Ceil(loadFactor * float64(total+1) * float64(r.nodes[node]) / float64(totalWeight))
+		if float64(loads[node]+1) <= limit {
+			return node
+		}
+	}
+	return first
+}
+
+// GetTruthNodeExcluding 从 key 在环上的位置顺时针查找第一个不在 exclude 中的节点
+// 所有节点都被排除时返回空字符串
+func (ch *ConsistentHash) GetTruthNodeExcluding(key string, exclude map[string]bool) string {
+	r := ch.ring.Load()
+	if len(r.virtualNodes) == 0 {
+		return ""
 	}
 
-	for i := 0; i < len(virtualHash); i++ {
-		for index, value := range ch.virtualNodes {
-			if virtualHash[i] == value {
-				ch.virtualNodes = append(ch.virtualNodes[:index], ch.virtualNodes[index+1:]...)
+	hash := int(ch.hash([]byte(key)))
+	idx := sort.Search(len(r.virtualNodes), func(i int) bool {
+		return r.virtualNodes[i] >= hash
+	})
+	checked := make(map[string]struct{}, len(r.nodes))
+	for i := 0; i < len(r.virtualNodes) && len(checked) < len(r.nodes); i++ {
+		node := r.hashMap[r.virtualNodes[(idx+i)%len(r.virtualNodes)]]
+		if !exclude[node] {
+			return node
+		}
+		checked[node] = struct{}{}
+	}
+	return ""
+}
+
+// RemovePeer 将真实节点及其虚拟节点从哈希环中删除，时间复杂度 O(n)
+// peer 的虚拟节点与其他节点冲突时，这个位置交给冲突节点中名称最小的节点，与从未加入过 peer 的环一致
+func (ch *ConsistentHash) RemovePeer(peer string) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	old := ch.ring.Load()
+	if _, ok := old.nodes[peer]; !ok {
+		return
+	}
+	r := &ring{
+		virtualNodes: make([]int, 0, len(old.virtualNodes)),
+		hashMap:      make(map[int]string, len(old.hashMap)),
+		nodes:        make(map[string]int, len(old.nodes)),
+	}
+	for node, weight := range old.nodes {
+		if node != peer {
+			r.nodes[node] = weight
+		}
+	}
+	// 找出 peer 的虚拟节点被冲突节点接管后的新归属
+	owned := make(map[int]string)
+	for hash, node := range old.hashMap {
+		if node == peer {
+			owned[hash] = ""
+		}
+	}
+	for node, weight := range r.nodes {
+		for i := 0; i < ch.replicas*weight; i++ {
+			hash := int(ch.hash([]byte(node + strconv.Itoa(i))))
+			if owner, ok := owned[hash]; ok && (owner == "" || node < owner) {
+				owned[hash] = node
 			}
 		}
 	}
+	// 过滤掉只属于 peer 的虚拟节点，剩余的虚拟节点仍然有序
+	for _, hash := range old.virtualNodes {
+		node := old.hashMap[hash]
+		if node == peer {
+			if node = owned[hash]; node == "" {
+				continue
+			}
+		}
+		r.virtualNodes = append(r.virtualNodes, hash)
+		r.hashMap[hash] = node
+	}
+	ch.ring.Store(r)
+}
+
+// Members 返回当前哈希环上的所有真实节点，按名称排序
+func (ch *ConsistentHash) Members() []string {
+	r := ch.ring.Load()
+	members := make([]string, 0, len(r.nodes))
+	for node := range r.nodes {
+		members = append(members, node)
+	}
+	sort.Strings(members)
+	return members
+}
 
-	logger.Logger.Warn("故障节点移除成功，相同请求应该打到其他节点上")
-	logger.Logger.Warn(len(ch.hashMap))
-	logger.Logger.Warn(len(ch.virtualNodes))
+// Weight 返回节点在哈希环上的权重，节点不在环上时返回 0
+func (ch *ConsistentHash) Weight(node string) int {
+	return ch.ring.Load().nodes[node]
 }
@@ -0,0 +1,106 @@
+package consistenthash
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// JumpHash 实现了 Google 的跳跃一致性哈希（Jump Consistent Hash），O(1) 内存、O(ln n) 查找
+// 算法只能把 key 映射到 [0, n) 的桶编号，因此节点按地址的字典序编号，保证各节点无论以什么顺序得知成员变化都得到相同的结果：
+// 加入字典序最大的节点时只有约 1/(n+1) 的 key 迁移；加入或移除中间的节点会让其后所有节点的编号移动，迁移量明显大于哈希环
+// 适用于节点很少变化、或者新节点地址按序递增的场景；不支持权重
+type JumpHash struct {
+	mu    sync.Mutex // 串行化写操作
+	nodes atomic.Pointer[[]string]
+}
+
+func NewJumpHash() *JumpHash {
+	j := &JumpHash{}
+	j.nodes.Store(&[]string{})
+	return j
+}
+
+func (j *JumpHash) AddTruthNode(nodes ...string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	old := *j.nodes.Load()
+	buckets := make([]string, len(old), len(old)+len(nodes))
+	copy(buckets, old)
+	for _, node := range nodes {
+		if indexOf(buckets, node) < 0 {
+			buckets = append(buckets, node)
+		}
+	}
+	sort.Strings(buckets)
+	j.nodes.Store(&buckets)
+}
+
+func (j *JumpHash) RemovePeer(peer string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	old := *j.nodes.Load()
+	idx := indexOf(old, peer)
+	if idx < 0 {
+		return
+	}
+	buckets := make([]string, 0, len(old)-1)
+	buckets = append(buckets, old[:idx]...)
+	buckets = append(buckets, old[idx+1:]...)
+	j.nodes.Store(&buckets)
+}
+
+func (j *JumpHash) GetTruthNode(key string) string {
+	return j.GetTruthNodeExcluding(key, nil)
+}
+
+// GetTruthNodeExcluding 在去掉 exclude 中的节点后的桶序列上计算 key 的归属
+func (j *JumpHash) GetTruthNodeExcluding(key string, exclude map[string]bool) string {
+	buckets := *j.nodes.Load()
+	if len(exclude) > 0 {
+		remain := make([]string, 0, len(buckets))
+		for _, node := range buckets {
+			if !exclude[node] {
+				remain = append(remain, node)
+			}
+		}
+		buckets = remain
+	}
+	if len(buckets) == 0 {
+		return ""
+	}
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return buckets[jump(h.Sum64(), len(buckets))]
+}
+
+func (j *JumpHash) Members() []string {
+	buckets := *j.nodes.Load()
+	members := make([]string, len(buckets))
+	copy(members, buckets)
+	sort.Strings(members)
+	return members
+}
+
+// jump 是论文 "A Fast, Minimal Memory, Consistent Hash Algorithm" 中的算法
+func jump(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+func indexOf(nodes []string, node string) int {
+	for i, n := range nodes {
+		if n == node {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,42 @@
+package consistenthash
+
+// Placement 定义了将 key 放置到真实节点上的算法，Server.Pick 通过它选择 key 的 owner
+// 实现需要保证并发安全：成员变更与查询可能同时发生
+type Placement interface {
+	// AddTruthNode 加入真实节点，已存在的节点会被忽略
+	AddTruthNode(nodes ...string)
+	// RemovePeer 移除真实节点
+	RemovePeer(peer string)
+	// GetTruthNode 返回 key 所在的真实节点，没有节点时返回空字符串
+	GetTruthNode(key string) string
+	// Members 返回当前所有真实节点，按名称排序
+	Members() []string
+}
+
+// WeightedPlacement 是支持按权重放置的 Placement
+type WeightedPlacement interface {
+	Placement
+	AddWeightedTruthNode(weights map[string]int)
+}
+
+// BoundedPlacement 是支持有界负载查找的 Placement
+type BoundedPlacement interface {
+	Placement
+	GetTruthNodeBounded(key string, loadFactor float64, loads map[string]int64) string
+}
+
+// ExcludingPlacement 是支持排除部分节点查找的 Placement
+// 返回的节点与把 exclude 中的节点移除之后 GetTruthNode 的结果一致，用于节点故障时临时转移它负责的 key
+type ExcludingPlacement interface {
+	Placement
+	GetTruthNodeExcluding(key string, exclude map[string]bool) string
+}
+
+var (
+	_ WeightedPlacement  = (*ConsistentHash)(nil)
+	_ BoundedPlacement   = (*ConsistentHash)(nil)
+	_ ExcludingPlacement = (*ConsistentHash)(nil)
+	_ WeightedPlacement  = (*Rendezvous)(nil)
+	_ ExcludingPlacement = (*Rendezvous)(nil)
+	_ ExcludingPlacement = (*JumpHash)(nil)
+)
@@ -0,0 +1,179 @@
+package consistenthash
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+// 放置算法的分布与迁移测试：
+// 1. skew：各节点负责的 key 数量的最大值 / 平均值，以及变异系数（标准差 / 平均值）
+// 2. moved：加入或移除一个节点后，负责节点发生变化的 key 占比，理想值约为 1/n
+// 使用 go test -v -run TestPlacement ./consistenthash 查看各算法的报告
+
+const (
+	harnessNodes    = 10
+	harnessKeys     = 20000
+	harnessReplicas = 50
+)
+
+var placements = []struct {
+	name string
+	new  func() Placement
+}{
+	{"ring", func() Placement { return NewConsistentHash(harnessReplicas, nil) }},
+	{"rendezvous", func() Placement { return NewRendezvous() }},
+	{"jump", func() Placement { return NewJumpHash() }},
+}
+
+// harnessNodeNames 返回的地址位数相同，字典序与编号顺序一致，追加的节点总是排在最后
+func harnessNodeNames(n int) []string {
+	nodes := make([]string, n)
+	for i := range nodes {
+		nodes[i] = fmt.Sprintf("10.0.0.%d:6324", i+10)
+	}
+	return nodes
+}
+
+func assign(p Placement) map[string]string {
+	owners := make(map[string]string, harnessKeys)
+	for i := 0; i < harnessKeys; i++ {
+		key := fmt.Sprintf("student:%d", i)
+		owners[key] = p.GetTruthNode(key)
+	}
+	return owners
+}
+
+func skew(owners map[string]string, nodes int) (maxOverMean, cv float64) {
+	counts := make(map[string]int)
+	for _, node := range owners {
+		counts[node]++
+	}
+	mean := float64(len(owners)) / float64(nodes)
+	var max, variance float64
+	for _, c := range counts {
+		max = math.Max(max, float64(c))
+		variance += (float64(c) - mean) * (float64(c) - mean)
+	}
+	return max / mean, math.Sqrt(variance/float64(nodes)) / mean
+}
+
+func moved(before, after map[string]string) float64 {
+	n := 0
+	for key, node := range before {
+		if after[key] != node {
+			n++
+		}
+	}
+	return float64(n) / float64(len(before))
+}
+
+func TestPlacementHarness(t *testing.T) {
+	nodes := harnessNodeNames(harnessNodes + 1)
+	for _, tc := range placements {
+		t.Run(tc.name, func(t *testing.T) {
+			p := tc.new()
+			p.AddTruthNode(nodes[:harnessNodes]...)
+			before := assign(p)
+			maxOverMean, cv := skew(before, harnessNodes)
+
+			// 追加一个节点
+			p.AddTruthNode(nodes[harnessNodes])
+			afterAdd := assign(p)
+			addMoved := moved(before, afterAdd)
+			p.RemovePeer(nodes[harnessNodes])
+
+			// 移除一个中间节点
+			p.RemovePeer(nodes[harnessNodes/2])
+			afterRemove := assign(p)
+			removeMoved := moved(before, afterRemove)
+
+			t.Logf("%-10s skew max/mean=%.3f cv=%.3f | moved on add=%.3f on remove=%.3f (ideal %.3f)",
+				tc.name, maxOverMean, cv, addMoved, removeMoved, 1/float64(harnessNodes+1))
+
+			if maxOverMean > 1.5 {
+				t.Errorf("%s: key distribution is too skewed, max/mean=%.3f", tc.name, maxOverMean)
+			}
+			// 追加节点时，迁移的 key 不应明显超过理想值
+			if addMoved > 2/float64(harnessNodes+1) {
+				t.Errorf("%s: too many keys moved on add: %.3f", tc.name, addMoved)
+			}
+			for key, node := range afterAdd {
+				if node != before[key] && node != nodes[harnessNodes] {
+					t.Fatalf("%s: key %s moved between existing nodes %s -> %s on add", tc.name, key, before[key], node)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkPlacement(b *testing.B) {
+	for _, tc := range placements {
+		b.Run(tc.name, func(b *testing.B) {
+			p := tc.new()
+			p.AddTruthNode(harnessNodeNames(harnessNodes)...)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				p.GetTruthNode(fmt.Sprintf("student:%d", i))
+			}
+		})
+	}
+}
+
+func TestPlacementExcluding(t *testing.T) {
+	nodes := harnessNodeNames(5)
+	for _, pl := range placements {
+		p := pl.new()
+		p.AddTruthNode(nodes...)
+		ex, ok := p.(ExcludingPlacement)
+		if !ok {
+			t.Fatalf("%s: expect ExcludingPlacement", pl.name)
+		}
+
+		// 排除一个节点的结果应与移除该节点后的结果一致
+		exclude := map[string]bool{nodes[2]: true}
+		removed := pl.new()
+		removed.AddTruthNode(nodes...)
+		removed.RemovePeer(nodes[2])
+		for i := 0; i < 1000; i++ {
+			key := fmt.Sprintf("student:%d", i)
+			if got, want := ex.GetTruthNodeExcluding(key, exclude), removed.GetTruthNode(key); got != want {
+				t.Fatalf("%s: key %s excluding got %s, expect %s", pl.name, key, got, want)
+			}
+		}
+
+		all := make(map[string]bool, len(nodes))
+		for _, node := range nodes {
+			all[node] = true
+		}
+		if got := ex.GetTruthNodeExcluding("student:1", all); got != "" {
+			t.Fatalf("%s: expect empty result when all nodes excluded, got %s", pl.name, got)
+		}
+	}
+}
+
+func TestJumpHashOrder(t *testing.T) {
+	// 各节点得知成员的顺序不同（SetPeers 遍历 map、etcd watch 事件的先后），计算出的 owner 应当一致
+	nodes := []string{"10.0.0.2:6324", "10.0.0.10:6324", "10.0.0.1:6324", "10.0.0.3:6324"}
+	a, b := NewJumpHash(), NewJumpHash()
+	a.AddTruthNode(nodes...)
+	for i := len(nodes) - 1; i >= 0; i-- {
+		b.AddTruthNode(nodes[i])
+	}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("student:%d", i)
+		if got, want := b.GetTruthNode(key), a.GetTruthNode(key); got != want {
+			t.Fatalf("key %s: got %s, expect %s", key, got, want)
+		}
+	}
+
+	// 节点下线再上线后回到原来的位置
+	b.RemovePeer(nodes[2])
+	b.AddTruthNode(nodes[2])
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("student:%d", i)
+		if got, want := b.GetTruthNode(key), a.GetTruthNode(key); got != want {
+			t.Fatalf("key %s after rejoin: got %s, expect %s", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package consistenthash
+
+import (
+	"hash/fnv"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Rendezvous 实现了最高随机权重（HRW）哈希：对每个节点计算 hash(node, key) 的得分，得分最高的节点负责该 key
+// 成员变更时只有被移除节点上的 key 或被新节点"抢走"的 key 会迁移，不需要虚拟节点，但每次查找是 O(n) 的
+// 权重使用对数法计算：score = weight / -ln(h)，其中 h 是归一化到 (0, 1) 的 hash 值
+type Rendezvous struct {
+	mu    sync.Mutex // 串行化写操作
+	nodes atomic.Pointer[map[string]int]
+}
+
+func NewRendezvous() *Rendezvous {
+	r := &Rendezvous{}
+	r.nodes.Store(&map[string]int{})
+	return r
+}
+
+func (r *Rendezvous) AddTruthNode(nodes ...string) {
+	weights := make(map[string]int, len(nodes))
+	for _, node := range nodes {
+		weights[node] = 1
+	}
+	r.AddWeightedTruthNode(weights)
+}
+
+// AddWeightedTruthNode 按权重加入真实节点，权重小于 1 时按 1 处理，已存在的节点会被忽略
+func (r *Rendezvous) AddWeightedTruthNode(weights map[string]int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	old := *r.nodes.Load()
+	nodes := make(map[string]int, len(old)+len(weights))
+	for node, weight := range old {
+		nodes[node] = weight
+	}
+	for node, weight := range weights {
+		if _, ok := nodes[node]; ok {
+			continue
+		}
+		if weight < 1 {
+			weight = 1
+		}
+		nodes[node] = weight
+	}
+	r.nodes.Store(&nodes)
+}
+
+func (r *Rendezvous) RemovePeer(peer string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	old := *r.nodes.Load()
+	if _, ok := old[peer]; !ok {
+		return
+	}
+	nodes := make(map[string]int, len(old))
+	for node, weight := range old {
+		if node != peer {
+			nodes[node] = weight
+		}
+	}
+	r.nodes.Store(&nodes)
+}
+
+func (r *Rendezvous) GetTruthNode(key string) string {
+	return r.GetTruthNodeExcluding(key, nil)
+}
+
+// GetTruthNodeExcluding 返回不在 exclude 中且得分最高的节点
+func (r *Rendezvous) GetTruthNodeExcluding(key string, exclude map[string]bool) string {
+	var best string
+	bestScore := math.Inf(-1)
+	for node, weight := range *r.nodes.Load() {
+		if exclude[node] {
+			continue
+		}
+		score := float64(weight) / -math.Log(hrwHash(node, key))
+		// 得分相同时按名称决出胜者，保证所有节点的选择一致
+		if score > bestScore || (score == bestScore && node < best) {
+			best, bestScore = node, score
+		}
+	}
+	return best
+}
+
+func (r *Rendezvous) Members() []string {
+	nodes := *r.nodes.Load()
+	members := make([]string, 0, len(nodes))
+	for node := range nodes {
+		members = append(members, node)
+	}
+	sort.Strings(members)
+	return members
+}
+
+// hrwHash 计算 (node, key) 的 hash，并归一化到开区间 (0, 1)
+func hrwHash(node, key string) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(node))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	// fnv 的低位扩散较差，再经过一轮 splitmix64 混合
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	// 取高 53 位作为尾数，加 0.5 避免出现 0
+	return (float64(x>>11) + 0.5) / (1 << 53)
+}
@@ -0,0 +1,120 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// 对外暴露的错误类型，节点之间通过 gRPC 状态码传递，调用方可以直接使用 errors.Is 判断
+var (
+	// ErrNotFound 表示数据源中不存在这个 key
+	// Retriever 返回的错误满足 errors.Is(err, ErrNotFound) 时，Group 会把这个结果作为否定条目缓存一段时间，
+	// 避免不存在的 key 每次都穿透到数据源；远端节点的查询结果也会保留这个语义
+	ErrNotFound = errors.New("key not found")
+	// ErrGroupNotFound 表示节点上没有创建对应的 Group
+	ErrGroupNotFound = errors.New("group not found")
+	// ErrInvalidRequest 表示请求缺少 group 或 key
+	ErrInvalidRequest = errors.New("key and group name is required")
+	// ErrValueTooLarge 表示 value 超过了节点的 MaxValueBytes
+	ErrValueTooLarge = errors.New("value too large")
+	// ErrRetrieve 表示 Retriever 从数据源取数据失败，原始错误同样可以通过 errors.Is/As 获取
+	ErrRetrieve = errors.New("retrieve from data source failed")
+	// ErrPeerUnavailable 表示远端节点不可达
+	ErrPeerUnavailable = errors.New("peer unavailable")
+)
+
+// wrapRetrieveError 为 Retriever 返回的错误标记 ErrRetrieve
+// 数据不存在和 ctx 取消不属于数据源故障，保持原样
+func wrapRetrieveError(err error) error {
+	if err == nil || errors.Is(err, ErrNotFound) || errors.Is(err, ErrRetrieve) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrRetrieve, err)
+}
+
+// errorCodes 定义了错误类型与 gRPC 状态码之间的映射，两个方向共用
+var errorCodes = []struct {
+	err  error
+	code codes.Code
+}{
+	{ErrNotFound, codes.NotFound},
+	{ErrGroupNotFound, codes.FailedPrecondition},
+	{ErrInvalidRequest, codes.InvalidArgument},
+	{ErrValueTooLarge, codes.ResourceExhausted},
+	{ErrRetrieve, codes.Internal},
+	{ErrPeerUnavailable, codes.Unavailable},
+	{context.DeadlineExceeded, codes.DeadlineExceeded},
+	{context.Canceled, codes.Canceled},
+}
+
+// errorCode 返回 err 对应的 gRPC 状态码
+func errorCode(err error) codes.Code {
+	for _, ec := range errorCodes {
+		if errors.Is(err, ec.err) {
+			return ec.code
+		}
+	}
+	return codes.Unknown
+}
+
+// toStatus 将 Server 处理请求时产生的错误转换成携带状态码的 gRPC 错误
+func toStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	return status.Error(errorCode(err), statusMessage(err))
+}
+
+// statusMessage 返回 err 在 gRPC 状态中携带的错误信息
+// 数据源故障与 gRPC 自身产生的错误（例如消息解码失败）使用同一个 codes.Internal，以 ErrRetrieve 的信息开头加以区分
+func statusMessage(err error) string {
+	msg := err.Error()
+	if errors.Is(err, ErrRetrieve) && !strings.HasPrefix(msg, ErrRetrieve.Error()) {
+		msg = ErrRetrieve.Error() + ": " + msg
+	}
+	return msg
+}
+
+// peerError 是从 gRPC 状态还原出来的错误，保留远端节点的错误信息，并可以通过 errors.Is 匹配错误类型
+type peerError struct {
+	kind error
+	msg  string
+}
+
+func (e *peerError) Error() string { return e.msg }
+
+func (e *peerError) Unwrap() error { return e.kind }
+
+// fromStatus 将 gRPC 错误还原成对应类型的错误，是 toStatus 的逆过程
+// 未定义的状态码，以及信息不以 ErrRetrieve 开头的 codes.Internal 原样返回
+func fromStatus(err error) error {
+	st, ok := status.FromError(err)
+	if !ok || err == nil {
+		return err
+	}
+	for _, ec := range errorCodes {
+		if ec.code == st.Code() {
+			if ec.err == ErrRetrieve && !strings.HasPrefix(st.Message(), ErrRetrieve.Error()) {
+				return err
+			}
+			return &peerError{kind: ec.err, msg: st.Message()}
+		}
+	}
+	return err
+}
+
+// isPeerFailure 判断错误是否说明远端节点本身出了问题，远端节点正常返回的业务错误不算在内
+// gRPC 自身产生的 Internal 错误经过 fromStatus 之后没有对应的错误类型，同样算作远端节点的问题
+// 超时是否算作远端节点的问题取决于截止时间由谁设置，由调用方（client.observe）判断
+func isPeerFailure(err error) bool {
+	return errors.Is(err, ErrPeerUnavailable) || errorCode(err) == codes.Unknown
+}
@@ -0,0 +1,196 @@
+package eviction
+
+import (
+	"container/list"
+	"time"
+
+	"github.com/1055373165/groupcache/lru"
+)
+
+// ARCCache 实现了自适应替换缓存（Megiddo & Modha），容量按字节数计量：
+//   - t1 保存最近只访问过一次的条目，t2 保存访问过多次的条目
+//   - b1、b2 分别记录最近从 t1、t2 淘汰的 key（幽灵队列）
+//   - p 是 t1 的目标字节数：命中 b1 说明 t1 太小，增大 p；命中 b2 说明 t2 太小，减小 p
+type ARCCache struct {
+	maxBytes  int64
+	p         int64
+	items     map[string]*list.Element
+	t1, t2    *segment
+	b1, b2    *ghost
+	onEvicted OnEvicted
+}
+
+func NewARC(maxBytes int64, onEvicted OnEvicted) *ARCCache {
+	return &ARCCache{
+		maxBytes:  maxBytes,
+		items:     make(map[string]*list.Element),
+		t1:        newSegment(),
+		t2:        newSegment(),
+		b1:        newGhost(),
+		b2:        newGhost(),
+		onEvicted: onEvicted,
+	}
+}
+
+func (c *ARCCache) Get(key string) (lru.Value, bool) {
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*entry)
+	if e.expired(time.Now()) {
+		c.remove(el, lru.Expired)
+		return nil, false
+	}
+	if e.seg == c.t1 {
+		c.t1.remove(el)
+		c.items[key] = c.t2.pushFront(e)
+	} else {
+		c.t2.ll.MoveToFront(el)
+	}
+	return e.value, true
+}
+
+func (c *ARCCache) PutWithExpire(key string, value lru.Value, expire time.Time) {
+	if el, ok := c.items[key]; ok {
+		e := c.remove0(el)
+		e.value, e.expire = value, expire
+		c.items[key] = c.t2.pushFront(e)
+		c.replace(false)
+		return
+	}
+
+	e := &entry{key: key, value: value, expire: expire}
+	switch {
+	case c.b1.contains(key):
+		// 命中 b1：t1 的容量不够，增大 p
+		delta := e.size()
+		if c.b1.len() < c.b2.len() {
+			delta *= int64(c.b2.len() / c.b1.len())
+		}
+		c.p = min64(c.maxBytes, c.p+delta)
+		c.b1.remove(key)
+		c.items[key] = c.t2.pushFront(e)
+		c.replace(false)
+	case c.b2.contains(key):
+		// 命中 b2：t2 的容量不够，减小 p
+		delta := e.size()
+		if c.b2.len() < c.b1.len() {
+			delta *= int64(c.b1.len() / c.b2.len())
+		}
+		c.p = max64(0, c.p-delta)
+		c.b2.remove(key)
+		c.items[key] = c.t2.pushFront(e)
+		c.replace(true)
+	default:
+		c.items[key] = c.t1.pushFront(e)
+		c.replace(false)
+	}
+	c.trimGhosts()
+}
+
+// replace 淘汰条目直到占用不超过容量
+func (c *ARCCache) replace(b2Hit bool) {
+	for c.maxBytes != 0 && c.Bytes() > c.maxBytes {
+		c.replaceOne(b2Hit)
+	}
+}
+
+// replaceOne 淘汰一个条目，t1 超过目标大小 p 时淘汰 t1，否则淘汰 t2，被淘汰的 key 进入对应的幽灵队列
+func (c *ARCCache) replaceOne(b2Hit bool) {
+	if c.t1.len() > 0 && (c.t1.bytes > c.p || (b2Hit && c.t1.bytes == c.p) || c.t2.len() == 0) {
+		e := c.remove(c.t1.back(), lru.Evicted)
+		c.b1.add(e.key, e.size())
+	} else {
+		e := c.remove(c.t2.back(), lru.Evicted)
+		c.b2.add(e.key, e.size())
+	}
+}
+
+// Evict 淘汰一个条目，缓存为空时返回 false
+func (c *ARCCache) Evict() bool {
+	if len(c.items) == 0 {
+		return false
+	}
+	c.replaceOne(false)
+	c.trimGhosts()
+	return true
+}
+
+// trimGhosts 限制幽灵队列的大小：|t1|+|b1| 不超过容量，四个队列之和不超过两倍容量
+func (c *ARCCache) trimGhosts() {
+	if c.maxBytes == 0 {
+		return
+	}
+	for c.b1.len() > 0 && c.t1.bytes+c.b1.bytes > c.maxBytes {
+		c.b1.removeOldest()
+	}
+	for c.b2.len() > 0 && c.Bytes()+c.b1.bytes+c.b2.bytes > 2*c.maxBytes {
+		c.b2.removeOldest()
+	}
+}
+
+func (c *ARCCache) Remove(key string) bool {
+	if el, ok := c.items[key]; ok {
+		c.remove(el, lru.Removed)
+		return true
+	}
+	return false
+}
+
+func (c *ARCCache) RemoveExpired() int {
+	now := time.Now()
+	n := 0
+	for _, el := range c.items {
+		if el.Value.(*entry).expired(now) {
+			c.remove(el, lru.Expired)
+			n++
+		}
+	}
+	return n
+}
+
+func (c *ARCCache) Keys() []string {
+	keys := make([]string, 0, len(c.items))
+	for key := range c.items {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (c *ARCCache) Len() int {
+	return len(c.items)
+}
+
+func (c *ARCCache) Bytes() int64 {
+	return c.t1.bytes + c.t2.bytes
+}
+
+func (c *ARCCache) remove0(el *list.Element) *entry {
+	e := el.Value.(*entry)
+	e.seg.remove(el)
+	delete(c.items, e.key)
+	return e
+}
+
+func (c *ARCCache) remove(el *list.Element, reason lru.EvictReason) *entry {
+	e := c.remove0(el)
+	if c.onEvicted != nil {
+		c.onEvicted(e.key, e.value, reason)
+	}
+	return e
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
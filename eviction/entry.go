@@ -0,0 +1,108 @@
+package eviction
+
+import (
+	"container/list"
+	"time"
+
+	"github.com/1055373165/groupcache/lru"
+)
+
+// entry 是各个策略共用的缓存条目
+type entry struct {
+	key    string
+	value  lru.Value
+	expire time.Time // 过期时间，零值表示永不过期
+	seg    *segment  // 条目当前所在的队列
+	freq   int       // 访问次数，LFU 使用
+	tick   uint64    // 最近一次访问的逻辑时间，LFU 使用
+	index  int       // 在堆中的下标，LFU 使用
+}
+
+func (e *entry) size() int64 {
+	return int64(len(e.key) + e.value.Len())
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return !e.expire.IsZero() && !now.Before(e.expire)
+}
+
+// segment 是按字节数计量的 LRU 队列，队头为最近访问的条目
+type segment struct {
+	ll    *list.List
+	bytes int64
+}
+
+func newSegment() *segment {
+	return &segment{ll: list.New()}
+}
+
+func (s *segment) pushFront(e *entry) *list.Element {
+	e.seg = s
+	s.bytes += e.size()
+	return s.ll.PushFront(e)
+}
+
+func (s *segment) remove(el *list.Element) *entry {
+	e := s.ll.Remove(el).(*entry)
+	s.bytes -= e.size()
+	e.seg = nil
+	return e
+}
+
+// back 返回队尾（最久未访问）的元素，队列为空时返回 nil
+func (s *segment) back() *list.Element {
+	return s.ll.Back()
+}
+
+func (s *segment) len() int {
+	return s.ll.Len()
+}
+
+// ghost 记录最近被淘汰的 key，只保存 key 和条目大小，不保存 value
+type ghost struct {
+	ll    *list.List
+	m     map[string]*list.Element
+	bytes int64 // 被淘汰时条目的大小之和
+}
+
+type ghostEntry struct {
+	key  string
+	size int64
+}
+
+func newGhost() *ghost {
+	return &ghost{ll: list.New(), m: make(map[string]*list.Element)}
+}
+
+func (g *ghost) add(key string, size int64) {
+	if el, ok := g.m[key]; ok {
+		g.ll.MoveToFront(el)
+		return
+	}
+	g.m[key] = g.ll.PushFront(&ghostEntry{key: key, size: size})
+	g.bytes += size
+}
+
+func (g *ghost) contains(key string) bool {
+	_, ok := g.m[key]
+	return ok
+}
+
+func (g *ghost) remove(key string) {
+	if el, ok := g.m[key]; ok {
+		ge := g.ll.Remove(el).(*ghostEntry)
+		delete(g.m, key)
+		g.bytes -= ge.size
+	}
+}
+
+// removeOldest 删除最早被记录的 key
+func (g *ghost) removeOldest() {
+	if el := g.ll.Back(); el != nil {
+		g.remove(el.Value.(*ghostEntry).key)
+	}
+}
+
+func (g *ghost) len() int {
+	return g.ll.Len()
+}
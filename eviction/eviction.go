@@ -0,0 +1,77 @@
+package eviction
+
+import (
+	"time"
+
+	"github.com/1055373165/groupcache/lru"
+)
+
+// eviction 模块定义了缓存淘汰策略的接口以及多种实现
+// lru.LRUCache 在一次性扫描大量冷数据时（例如批量任务遍历所有 Student）会把热点数据全部挤出，
+// LFU、2Q、ARC 和 W-TinyLFU 通过记录访问频率或区分"只访问过一次"与"多次访问"的数据来抵抗这种污染
+
+// OnEvicted 在条目被移出缓存时调用
+type OnEvicted func(key string, value lru.Value, reason lru.EvictReason)
+
+// Policy 是按字节数限制容量的缓存淘汰策略
+// 实现不需要保证并发安全，由上层的 cache 分片加锁
+type Policy interface {
+	Get(key string) (lru.Value, bool)
+	// PutWithExpire 写入条目，expire 为零值表示永不过期；写入后占用超过容量时按策略淘汰
+	PutWithExpire(key string, value lru.Value, expire time.Time)
+	// Remove 主动删除 key 对应的条目，key 不存在时返回 false
+	Remove(key string) bool
+	// RemoveExpired 清理所有已过期的条目，返回清理的条目数
+	RemoveExpired() int
+	// Keys 返回当前所有的 key，顺序不做保证
+	Keys() []string
+	Len() int
+	Bytes() int64
+}
+
+// Evicter 是可以按淘汰策略主动淘汰一个条目的 Policy
+// 上层的 cache 借助它让所有分片共享同一份容量：写入后总占用超过容量时，由分片按各自的策略淘汰条目
+type Evicter interface {
+	// Evict 淘汰一个按策略最应该被淘汰的条目，缓存为空时返回 false
+	Evict() bool
+}
+
+// Factory 根据容量（字节数，0 表示不限制）和淘汰回调创建一个 Policy
+type Factory func(maxBytes int64, onEvicted OnEvicted) Policy
+
+var (
+	// LRU 淘汰最久未被访问的条目
+	LRU Factory = func(maxBytes int64, onEvicted OnEvicted) Policy {
+		return lru.NewLRUCache(maxBytes, onEvicted)
+	}
+	// LFU 淘汰访问次数最少的条目，访问次数相同时淘汰最久未被访问的
+	LFU Factory = func(maxBytes int64, onEvicted OnEvicted) Policy {
+		return NewLFU(maxBytes, onEvicted)
+	}
+	// TwoQueue 是 2Q 算法，只访问过一次的条目不会挤占多次访问的条目
+	TwoQueue Factory = func(maxBytes int64, onEvicted OnEvicted) Policy {
+		return NewTwoQueue(maxBytes, onEvicted)
+	}
+	// ARC 是自适应替换缓存，根据幽灵队列的命中情况动态调整"最近"与"频繁"两部分的容量
+	ARC Factory = func(maxBytes int64, onEvicted OnEvicted) Policy {
+		return NewARC(maxBytes, onEvicted)
+	}
+	// TinyLFU 是 W-TinyLFU，新条目先进入窗口 LRU，再由 count-min sketch 估计的频率决定能否进入主缓存
+	TinyLFU Factory = func(maxBytes int64, onEvicted OnEvicted) Policy {
+		return NewTinyLFU(maxBytes, onEvicted)
+	}
+)
+
+var (
+	_ Policy = (*lru.LRUCache)(nil)
+	_ Policy = (*LFUCache)(nil)
+	_ Policy = (*TwoQueueCache)(nil)
+	_ Policy = (*ARCCache)(nil)
+	_ Policy = (*TinyLFUCache)(nil)
+
+	_ Evicter = (*lru.LRUCache)(nil)
+	_ Evicter = (*LFUCache)(nil)
+	_ Evicter = (*TwoQueueCache)(nil)
+	_ Evicter = (*ARCCache)(nil)
+	_ Evicter = (*TinyLFUCache)(nil)
+)
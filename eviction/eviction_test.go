@@ -0,0 +1,192 @@
+package eviction
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/1055373165/groupcache/lru"
+)
+
+type value string
+
+func (v value) Len() int {
+	return len(v)
+}
+
+var factories = []struct {
+	name string
+	new  Factory
+}{
+	{"lru", LRU},
+	{"lfu", LFU},
+	{"2q", TwoQueue},
+	{"arc", ARC},
+	{"tinylfu", TinyLFU},
+}
+
+func TestPolicyBasic(t *testing.T) {
+	for _, f := range factories {
+		t.Run(f.name, func(t *testing.T) {
+			reasons := make(map[lru.EvictReason]int)
+			p := f.new(1000, func(key string, v lru.Value, reason lru.EvictReason) {
+				reasons[reason]++
+			})
+
+			p.PutWithExpire("k", value("v1"), time.Time{})
+			p.PutWithExpire("k", value("value2"), time.Time{})
+			if v, ok := p.Get("k"); !ok || v != value("value2") {
+				t.Fatalf("expect updated value2, but got %v", v)
+			}
+			if p.Bytes() != int64(len("k")+len("value2")) || p.Len() != 1 {
+				t.Fatalf("unexpected accounting: %d bytes, %d items", p.Bytes(), p.Len())
+			}
+			if keys := p.Keys(); len(keys) != 1 || keys[0] != "k" {
+				t.Fatalf("expect keys [k], but got %v", keys)
+			}
+
+			// 容量限制
+			for i := 0; i < 500; i++ {
+				key := fmt.Sprintf("key%d", i)
+				p.PutWithExpire(key, value("0123456789"), time.Time{})
+				p.Get(key)
+				if p.Bytes() > 1000 {
+					t.Fatalf("cache bytes %d exceed max bytes 1000", p.Bytes())
+				}
+			}
+			if reasons[lru.Evicted] == 0 {
+				t.Fatal("expect evictions when cache is over budget")
+			}
+
+			// 主动删除
+			p.PutWithExpire("removed", value("1"), time.Time{})
+			if !p.Remove("removed") || p.Remove("removed") {
+				t.Fatal("expect Remove to delete an existing key exactly once")
+			}
+			if _, ok := p.Get("removed"); ok || reasons[lru.Removed] != 1 {
+				t.Fatalf("removed key should not be returned, removed callbacks: %d", reasons[lru.Removed])
+			}
+
+			// 过期
+			p.PutWithExpire("past", value("1"), time.Now().Add(-time.Second))
+			if _, ok := p.Get("past"); ok {
+				t.Fatal("expired key should not be returned")
+			}
+			p.PutWithExpire("past2", value("2"), time.Now().Add(-time.Second))
+			p.PutWithExpire("future", value("3"), time.Now().Add(time.Hour))
+			p.RemoveExpired()
+			if reasons[lru.Expired] != 2 {
+				t.Fatalf("expect 2 expired callbacks, but got %d", reasons[lru.Expired])
+			}
+		})
+	}
+}
+
+// TestPolicyScanResistance 热点数据被反复访问后，一次性扫描大量冷数据，
+// 除 LRU 外的策略都应该保留大部分热点数据
+func TestPolicyScanResistance(t *testing.T) {
+	const (
+		hotKeys  = 50
+		coldKeys = 2000
+		entry    = 16 // key 与 value 的大小之和约为 16 字节
+	)
+	for _, f := range factories {
+		t.Run(f.name, func(t *testing.T) {
+			p := f.new(hotKeys*2*entry, nil)
+			access := func(key string) {
+				if _, ok := p.Get(key); !ok {
+					p.PutWithExpire(key, value("01234567"), time.Time{})
+				}
+			}
+			for round := 0; round < 5; round++ {
+				for i := 0; i < hotKeys; i++ {
+					access(fmt.Sprintf("hot%04d", i))
+				}
+			}
+			for i := 0; i < coldKeys; i++ {
+				access(fmt.Sprintf("cld%04d", i))
+			}
+			kept := 0
+			for i := 0; i < hotKeys; i++ {
+				if _, ok := p.Get(fmt.Sprintf("hot%04d", i)); ok {
+					kept++
+				}
+			}
+			t.Logf("%-8s kept %d/%d hot keys after scan", f.name, kept, hotKeys)
+			if f.name != "lru" && kept < hotKeys/2 {
+				t.Fatalf("%s should keep most hot keys after a scan, kept %d/%d", f.name, kept, hotKeys)
+			}
+		})
+	}
+}
+
+// BenchmarkHitRatio 在 Zipf 分布的访问序列上比较各策略的命中率，命中率以 hit% 指标报告：
+// go test -run xxx -bench HitRatio ./eviction
+func BenchmarkHitRatio(b *testing.B) {
+	const (
+		keys   = 100000
+		trace  = 200000
+		cached = keys / 10
+	)
+	for _, s := range []float64{1.01, 1.2} {
+		r := rand.New(rand.NewSource(1))
+		zipf := rand.NewZipf(r, s, 1, keys-1)
+		names := make([]string, trace)
+		for i := range names {
+			names[i] = fmt.Sprintf("student:%06d", zipf.Uint64())
+		}
+		size := int64(len(names[0]) + len("value"))
+		for _, f := range factories {
+			b.Run(fmt.Sprintf("zipf=%.2f/%s", s, f.name), func(b *testing.B) {
+				var hits, total int
+				for n := 0; n < b.N; n++ {
+					p := f.new(cached*size, nil)
+					for _, key := range names {
+						if _, ok := p.Get(key); ok {
+							hits++
+						} else {
+							p.PutWithExpire(key, value("value"), time.Time{})
+						}
+						total++
+					}
+				}
+				b.ReportMetric(100*float64(hits)/float64(total), "hit%")
+			})
+		}
+	}
+}
+
+func TestPolicyEvict(t *testing.T) {
+	for _, f := range factories {
+		t.Run(f.name, func(t *testing.T) {
+			evicted := 0
+			p := f.new(1000, func(key string, v lru.Value, reason lru.EvictReason) {
+				if reason == lru.Evicted {
+					evicted++
+				}
+			})
+			e, ok := p.(Evicter)
+			if !ok {
+				t.Fatal("expect policy to implement Evicter")
+			}
+			for i := 0; i < 10; i++ {
+				p.PutWithExpire(fmt.Sprintf("key%d", i), value("0123456789"), time.Time{})
+			}
+
+			// 最近写入的条目最后被淘汰
+			for i := 0; i < 9; i++ {
+				if !e.Evict() {
+					t.Fatalf("expect evict to succeed with %d items", p.Len())
+				}
+			}
+			if keys := p.Keys(); len(keys) != 1 || keys[0] != "key9" {
+				t.Fatalf("expect newest key9 to be evicted last, but got %v", keys)
+			}
+			e.Evict()
+			if e.Evict() || p.Len() != 0 || p.Bytes() != 0 || evicted != 10 {
+				t.Fatalf("expect empty cache after evicting all, got %d items, %d bytes, %d evicted", p.Len(), p.Bytes(), evicted)
+			}
+		})
+	}
+}
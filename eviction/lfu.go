@@ -0,0 +1,153 @@
+package eviction
+
+import (
+	"container/heap"
+	"time"
+
+	"github.com/1055373165/groupcache/lru"
+)
+
+// LFUCache 淘汰访问次数最少的条目，访问次数相同时淘汰最久未被访问的
+// 条目按 (访问次数, 最近访问时间) 组织成小顶堆，读写均为 O(log n)
+type LFUCache struct {
+	maxBytes  int64
+	nBytes    int64
+	items     map[string]*entry
+	heap      entryHeap
+	tick      uint64
+	onEvicted OnEvicted
+}
+
+func NewLFU(maxBytes int64, onEvicted OnEvicted) *LFUCache {
+	return &LFUCache{
+		maxBytes:  maxBytes,
+		items:     make(map[string]*entry),
+		onEvicted: onEvicted,
+	}
+}
+
+func (c *LFUCache) Get(key string) (lru.Value, bool) {
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	if e.expired(time.Now()) {
+		c.remove(e, lru.Expired)
+		return nil, false
+	}
+	c.touch(e)
+	return e.value, true
+}
+
+func (c *LFUCache) PutWithExpire(key string, value lru.Value, expire time.Time) {
+	if e, ok := c.items[key]; ok {
+		c.nBytes += int64(value.Len() - e.value.Len())
+		e.value, e.expire = value, expire
+		c.touch(e)
+	} else {
+		c.tick++
+		e := &entry{key: key, value: value, expire: expire, freq: 1, tick: c.tick}
+		heap.Push(&c.heap, e)
+		c.items[key] = e
+		c.nBytes += e.size()
+	}
+
+	for c.maxBytes != 0 && c.nBytes > c.maxBytes && c.heap.Len() > 0 {
+		c.remove(c.heap[0], lru.Evicted)
+	}
+}
+
+// Evict 淘汰访问次数最少、最久未访问的条目，缓存为空时返回 false
+func (c *LFUCache) Evict() bool {
+	if c.heap.Len() == 0 {
+		return false
+	}
+	c.remove(c.heap[0], lru.Evicted)
+	return true
+}
+
+func (c *LFUCache) Remove(key string) bool {
+	if e, ok := c.items[key]; ok {
+		c.remove(e, lru.Removed)
+		return true
+	}
+	return false
+}
+
+func (c *LFUCache) RemoveExpired() int {
+	now := time.Now()
+	n := 0
+	for _, e := range c.items {
+		if e.expired(now) {
+			c.remove(e, lru.Expired)
+			n++
+		}
+	}
+	return n
+}
+
+func (c *LFUCache) Keys() []string {
+	keys := make([]string, 0, len(c.items))
+	for key := range c.items {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (c *LFUCache) Len() int {
+	return len(c.items)
+}
+
+func (c *LFUCache) Bytes() int64 {
+	return c.nBytes
+}
+
+// touch 记录一次访问
+func (c *LFUCache) touch(e *entry) {
+	c.tick++
+	e.freq++
+	e.tick = c.tick
+	heap.Fix(&c.heap, e.index)
+}
+
+func (c *LFUCache) remove(e *entry, reason lru.EvictReason) {
+	heap.Remove(&c.heap, e.index)
+	delete(c.items, e.key)
+	c.nBytes -= e.size()
+	if c.onEvicted != nil {
+		c.onEvicted(e.key, e.value, reason)
+	}
+}
+
+// entryHeap 实现了 heap.Interface，堆顶为访问次数最少、最久未访问的条目
+type entryHeap []*entry
+
+func (h entryHeap) Len() int { return len(h) }
+
+func (h entryHeap) Less(i, j int) bool {
+	if h[i].freq != h[j].freq {
+		return h[i].freq < h[j].freq
+	}
+	return h[i].tick < h[j].tick
+}
+
+func (h entryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *entryHeap) Push(x interface{}) {
+	e := x.(*entry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *entryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return e
+}
@@ -0,0 +1,79 @@
+package eviction
+
+import "hash/fnv"
+
+// cmSketch 是 4 行的 count-min sketch，用 4 位计数器估计 key 的访问频率
+// 计数器以半字节存储，总增量达到 sampleSize 后所有计数器减半（老化），使频率估计能够跟随访问模式的变化
+type cmSketch struct {
+	rows       [4][]byte
+	mask       uint64
+	additions  int
+	sampleSize int
+}
+
+// newCMSketch 创建宽度为不小于 width 的 2 的幂的 sketch
+func newCMSketch(width int) *cmSketch {
+	w := 16
+	for w < width {
+		w <<= 1
+	}
+	s := &cmSketch{mask: uint64(w - 1), sampleSize: 10 * w}
+	for i := range s.rows {
+		s.rows[i] = make([]byte, w/2)
+	}
+	return s
+}
+
+func keyHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// index 使用双重哈希为第 i 行计算计数器下标
+func (s *cmSketch) index(h uint64, i int) uint64 {
+	h1, h2 := h, h>>32|h<<32
+	return (h1 + uint64(i)*h2 + uint64(i)*uint64(i)) & s.mask
+}
+
+func (s *cmSketch) get(row []byte, idx uint64) byte {
+	return (row[idx/2] >> ((idx & 1) * 4)) & 0x0f
+}
+
+// increment 将 key 的频率加一，计数器在 15 处饱和
+func (s *cmSketch) increment(key string) {
+	h := keyHash(key)
+	for i := range s.rows {
+		idx := s.index(h, i)
+		shift := (idx & 1) * 4
+		if v := (s.rows[i][idx/2] >> shift) & 0x0f; v < 15 {
+			s.rows[i][idx/2] += 1 << shift
+		}
+	}
+	s.additions++
+	if s.additions >= s.sampleSize {
+		s.reset()
+	}
+}
+
+// estimate 返回 key 频率的估计值，即各行计数器的最小值
+func (s *cmSketch) estimate(key string) byte {
+	h := keyHash(key)
+	min := byte(15)
+	for i := range s.rows {
+		if v := s.get(s.rows[i], s.index(h, i)); v < min {
+			min = v
+		}
+	}
+	return min
+}
+
+// reset 将所有计数器减半
+func (s *cmSketch) reset() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] = (s.rows[i][j] >> 1) & 0x77
+		}
+	}
+	s.additions /= 2
+}
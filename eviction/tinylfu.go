@@ -0,0 +1,226 @@
+package eviction
+
+import (
+	"container/list"
+	"time"
+
+	"github.com/1055373165/groupcache/lru"
+)
+
+const (
+	// 窗口 LRU 占总容量的比例
+	tinyLFUWindowRatio = 0.01
+	// 主缓存中 protected 段占主缓存容量的比例
+	tinyLFUProtectedRatio = 0.8
+	// 估计条目的平均大小，用于确定 sketch 的宽度
+	tinyLFUAvgEntryBytes = 64
+	// sketch 宽度上下限
+	tinyLFUMinSketchWidth = 1 << 10
+	tinyLFUMaxSketchWidth = 1 << 20
+)
+
+// TinyLFUCache 实现了 W-TinyLFU（Einziger et al.），也是 Caffeine 使用的策略：
+//   - 新条目先进入容量很小的窗口 LRU，以适应突发的访问
+//   - 被窗口淘汰的条目作为候选者，只有当 count-min sketch 估计的频率高于主缓存中将被淘汰的条目时才被接纳
+//   - 主缓存是分段 LRU：probation 段保存新接纳的条目，再次被访问后晋升到 protected 段
+type TinyLFUCache struct {
+	maxBytes     int64
+	windowMax    int64
+	protectedMax int64
+	items        map[string]*list.Element
+	window       *segment
+	probation    *segment
+	protected    *segment
+	sketch       *cmSketch
+	onEvicted    OnEvicted
+}
+
+func NewTinyLFU(maxBytes int64, onEvicted OnEvicted) *TinyLFUCache {
+	windowMax := int64(float64(maxBytes) * tinyLFUWindowRatio)
+	width := int(maxBytes / tinyLFUAvgEntryBytes)
+	if width < tinyLFUMinSketchWidth {
+		width = tinyLFUMinSketchWidth
+	}
+	if width > tinyLFUMaxSketchWidth {
+		width = tinyLFUMaxSketchWidth
+	}
+	return &TinyLFUCache{
+		maxBytes:     maxBytes,
+		windowMax:    windowMax,
+		protectedMax: int64(float64(maxBytes-windowMax) * tinyLFUProtectedRatio),
+		items:        make(map[string]*list.Element),
+		window:       newSegment(),
+		probation:    newSegment(),
+		protected:    newSegment(),
+		sketch:       newCMSketch(width),
+		onEvicted:    onEvicted,
+	}
+}
+
+// Get 无论是否命中都会记录一次访问，未命中的 key 在之后写入时才有机会凭借频率被接纳
+func (c *TinyLFUCache) Get(key string) (lru.Value, bool) {
+	c.sketch.increment(key)
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*entry)
+	if e.expired(time.Now()) {
+		c.remove(el, lru.Expired)
+		return nil, false
+	}
+	switch e.seg {
+	case c.window:
+		c.window.ll.MoveToFront(el)
+	case c.probation:
+		// 在 probation 段再次被访问，晋升到 protected 段
+		c.probation.remove(el)
+		c.items[key] = c.protected.pushFront(e)
+		c.demoteProtected()
+	case c.protected:
+		c.protected.ll.MoveToFront(el)
+	}
+	return e.value, true
+}
+
+func (c *TinyLFUCache) PutWithExpire(key string, value lru.Value, expire time.Time) {
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*entry)
+		seg := e.seg
+		c.remove0(el)
+		e.value, e.expire = value, expire
+		c.items[key] = seg.pushFront(e)
+		if seg == c.protected {
+			c.demoteProtected()
+		}
+	} else {
+		e := &entry{key: key, value: value, expire: expire}
+		c.items[key] = c.window.pushFront(e)
+	}
+	if c.maxBytes == 0 {
+		return
+	}
+	c.evictWindow()
+	c.evictMain()
+}
+
+// demoteProtected protected 段超过容量时，将其中最久未访问的条目降级到 probation 段
+func (c *TinyLFUCache) demoteProtected() {
+	for c.protected.bytes > c.protectedMax && c.protected.len() > 1 {
+		e := c.protected.remove(c.protected.back())
+		c.items[e.key] = c.probation.pushFront(e)
+	}
+}
+
+// evictWindow 将超出窗口容量的条目交给准入策略：主缓存有空间时直接进入 probation，
+// 否则与主缓存中即将被淘汰的条目比较频率，频率更高者留下
+func (c *TinyLFUCache) evictWindow() {
+	for c.window.bytes > c.windowMax && c.window.len() > 0 {
+		candidate := c.window.remove(c.window.back())
+		c.items[candidate.key] = c.probation.pushFront(candidate)
+		if c.Bytes() <= c.maxBytes {
+			continue
+		}
+		victim := c.victim(candidate)
+		if victim == nil {
+			continue
+		}
+		if c.sketch.estimate(candidate.key) > c.sketch.estimate(victim.Value.(*entry).key) {
+			c.remove(victim, lru.Evicted)
+		} else {
+			c.remove(c.items[candidate.key], lru.Evicted)
+		}
+	}
+}
+
+// victim 返回主缓存中下一个将被淘汰的条目（跳过候选者自身），优先从 probation 段选择
+func (c *TinyLFUCache) victim(candidate *entry) *list.Element {
+	for _, seg := range []*segment{c.probation, c.protected} {
+		for el := seg.back(); el != nil; el = el.Prev() {
+			if el.Value.(*entry) != candidate {
+				return el
+			}
+		}
+	}
+	return nil
+}
+
+// evictMain 主缓存仍然超出容量时（例如单个条目很大），按 probation、protected、window 的顺序淘汰
+func (c *TinyLFUCache) evictMain() {
+	for c.Bytes() > c.maxBytes {
+		c.evictOne()
+	}
+}
+
+// Evict 按 probation、protected、window 的顺序淘汰一个条目，缓存为空时返回 false
+func (c *TinyLFUCache) Evict() bool {
+	if len(c.items) == 0 {
+		return false
+	}
+	c.evictOne()
+	return true
+}
+
+func (c *TinyLFUCache) evictOne() {
+	var el *list.Element
+	switch {
+	case c.probation.len() > 0:
+		el = c.probation.back()
+	case c.protected.len() > 0:
+		el = c.protected.back()
+	default:
+		el = c.window.back()
+	}
+	c.remove(el, lru.Evicted)
+}
+
+func (c *TinyLFUCache) Remove(key string) bool {
+	if el, ok := c.items[key]; ok {
+		c.remove(el, lru.Removed)
+		return true
+	}
+	return false
+}
+
+func (c *TinyLFUCache) RemoveExpired() int {
+	now := time.Now()
+	n := 0
+	for _, el := range c.items {
+		if el.Value.(*entry).expired(now) {
+			c.remove(el, lru.Expired)
+			n++
+		}
+	}
+	return n
+}
+
+func (c *TinyLFUCache) Keys() []string {
+	keys := make([]string, 0, len(c.items))
+	for key := range c.items {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (c *TinyLFUCache) Len() int {
+	return len(c.items)
+}
+
+func (c *TinyLFUCache) Bytes() int64 {
+	return c.window.bytes + c.probation.bytes + c.protected.bytes
+}
+
+func (c *TinyLFUCache) remove0(el *list.Element) *entry {
+	e := el.Value.(*entry)
+	e.seg.remove(el)
+	delete(c.items, e.key)
+	return e
+}
+
+func (c *TinyLFUCache) remove(el *list.Element, reason lru.EvictReason) *entry {
+	e := c.remove0(el)
+	if c.onEvicted != nil {
+		c.onEvicted(e.key, e.value, reason)
+	}
+	return e
+}
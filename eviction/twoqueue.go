@@ -0,0 +1,162 @@
+package eviction
+
+import (
+	"container/list"
+	"time"
+
+	"github.com/1055373165/groupcache/lru"
+)
+
+const (
+	// 2Q 中 recent 队列占总容量的比例
+	twoQueueRecentRatio = 0.25
+)
+
+// TwoQueueCache 实现了简化的 2Q 算法（Johnson & Shasha）：
+//   - recent 保存只被访问过一次的条目，容量较小，一次性扫描的冷数据只会在这里流转
+//   - frequent 保存被访问过至少两次的条目
+//   - ghost 记录最近从 recent 淘汰的 key，再次写入时说明它并不是一次性数据，直接进入 frequent
+type TwoQueueCache struct {
+	maxBytes     int64
+	recentTarget int64
+	items        map[string]*list.Element
+	recent       *segment
+	frequent     *segment
+	ghost        *ghost
+	onEvicted    OnEvicted
+}
+
+func NewTwoQueue(maxBytes int64, onEvicted OnEvicted) *TwoQueueCache {
+	return &TwoQueueCache{
+		maxBytes:     maxBytes,
+		recentTarget: int64(float64(maxBytes) * twoQueueRecentRatio),
+		items:        make(map[string]*list.Element),
+		recent:       newSegment(),
+		frequent:     newSegment(),
+		ghost:        newGhost(),
+		onEvicted:    onEvicted,
+	}
+}
+
+func (c *TwoQueueCache) Get(key string) (lru.Value, bool) {
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*entry)
+	if e.expired(time.Now()) {
+		c.remove(el, lru.Expired)
+		return nil, false
+	}
+	// 第二次访问，从 recent 晋升到 frequent
+	if e.seg == c.recent {
+		c.recent.remove(el)
+		c.items[key] = c.frequent.pushFront(e)
+	} else {
+		c.frequent.ll.MoveToFront(el)
+	}
+	return e.value, true
+}
+
+func (c *TwoQueueCache) PutWithExpire(key string, value lru.Value, expire time.Time) {
+	if el, ok := c.items[key]; ok {
+		e := c.remove0(el)
+		e.value, e.expire = value, expire
+		c.items[key] = c.frequent.pushFront(e)
+		c.evict()
+		return
+	}
+
+	e := &entry{key: key, value: value, expire: expire}
+	if c.ghost.contains(key) {
+		// 最近刚从 recent 被淘汰又被写入，说明不是一次性数据
+		c.ghost.remove(key)
+		c.items[key] = c.frequent.pushFront(e)
+	} else {
+		c.items[key] = c.recent.pushFront(e)
+	}
+	c.evict()
+}
+
+// evict 淘汰条目直到占用不超过容量
+func (c *TwoQueueCache) evict() {
+	for c.maxBytes != 0 && c.Bytes() > c.maxBytes {
+		c.evictOne(c.recentTarget)
+	}
+}
+
+// Evict 淘汰一个条目，缓存为空时返回 false
+// 容量由上层共享时单个实例的占用可能远小于 maxBytes，recent 的目标大小按当前占用计算
+func (c *TwoQueueCache) Evict() bool {
+	if len(c.items) == 0 {
+		return false
+	}
+	c.evictOne(int64(float64(c.Bytes()) * twoQueueRecentRatio))
+	return true
+}
+
+// evictOne 淘汰一个条目：recent 超过 recentTarget 时优先淘汰 recent，否则淘汰 frequent
+func (c *TwoQueueCache) evictOne(recentTarget int64) {
+	if c.recent.len() > 0 && (c.recent.bytes > recentTarget || c.frequent.len() == 0) {
+		e := c.remove(c.recent.back(), lru.Evicted)
+		c.ghost.add(e.key, e.size())
+		// ghost 只保存 key，条目数与当前缓存的条目数保持同一量级
+		for c.ghost.len() > len(c.items)+1 {
+			c.ghost.removeOldest()
+		}
+	} else {
+		c.remove(c.frequent.back(), lru.Evicted)
+	}
+}
+
+func (c *TwoQueueCache) Remove(key string) bool {
+	if el, ok := c.items[key]; ok {
+		c.remove(el, lru.Removed)
+		return true
+	}
+	return false
+}
+
+func (c *TwoQueueCache) RemoveExpired() int {
+	now := time.Now()
+	n := 0
+	for _, el := range c.items {
+		if el.Value.(*entry).expired(now) {
+			c.remove(el, lru.Expired)
+			n++
+		}
+	}
+	return n
+}
+
+func (c *TwoQueueCache) Keys() []string {
+	keys := make([]string, 0, len(c.items))
+	for key := range c.items {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (c *TwoQueueCache) Len() int {
+	return len(c.items)
+}
+
+func (c *TwoQueueCache) Bytes() int64 {
+	return c.recent.bytes + c.frequent.bytes
+}
+
+// remove0 将条目从所在队列和索引中移除，不触发回调
+func (c *TwoQueueCache) remove0(el *list.Element) *entry {
+	e := el.Value.(*entry)
+	e.seg.remove(el)
+	delete(c.items, e.key)
+	return e
+}
+
+func (c *TwoQueueCache) remove(el *list.Element, reason lru.EvictReason) *entry {
+	e := c.remove0(el)
+	if c.onEvicted != nil {
+		c.onEvicted(e.key, e.value, reason)
+	}
+	return e
+}
@@ -1,25 +1,67 @@
 package etcd
 
 import (
+	"context"
 	"errors"
-
-	"github.com/1055373165/groupcache/logger"
-
+	"fmt"
+	"math/rand"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/1055373165/groupcache/eviction"
+	"github.com/1055373165/groupcache/logger"
 	"github.com/1055373165/groupcache/singleflight"
 )
 
 // groupcache 模块提供比 cache 更高一层的抽象能力
 // 实现了填充缓存、命名划分缓存的能力
+const (
+	// hotCache 的容量默认为 mainCache 的 1/defaultHotCacheRatio
+	defaultHotCacheRatio = 8
+	// 从远端节点取回的值以 1/hotCacheOdds 的概率放入 hotCache
+	hotCacheOdds = 10
+	// 后台清理过期条目的间隔
+	defaultJanitorInterval = time.Minute
+	// 数据源中不存在的 key 默认缓存的时长
+	defaultNotFoundTTL = 10 * time.Second
+	// ServeStale 策略下，条目过期后继续保留的时长
+	defaultStaleTTL = 5 * time.Minute
+	// 后台刷新旧值的超时时间
+	defaultRefreshTimeout = 10 * time.Second
+	// 热路径日志的限流：每秒同一条消息只输出前 logSampleFirst 次，之后每 logSampleThereafter 次输出一次
+	logSamplePeriod     = time.Second
+	logSampleFirst      = 10
+	logSampleThereafter = 100
+)
+
+// FailurePolicy 决定 key 的 owner 请求失败时 Group 的行为
+type FailurePolicy int
+
+const (
+	// FallbackLocal 在本节点回源，这是默认策略；owner 持续故障时所有节点都会回源到数据源
+	FallbackLocal FailurePolicy = iota
+	// NextPeer 改为请求哈希环上的下一个节点，下一个节点是本节点时在本节点回源
+	NextPeer
+	// ReturnError 直接返回错误，不回源
+	ReturnError
+	// ServeStale 返回本节点缓存中已过期但仍在保留期内的旧值，没有旧值时返回错误
+	// 本节点作为 owner 回源失败时同样返回旧值
+	ServeStale
+)
+
 var (
 	mu     sync.RWMutex
 	groups = make(map[string]*Group)
 )
 
 // Retriever 要求对象实现从数据源获取数据的能力
+// 返回的 expire 为零值时表示数据永不过期
 type Retriever interface {
-	retrieve(string) ([]byte, error)
+	retrieve(context.Context, string) ([]byte, time.Time, error)
 }
 
 type RetrieveFunc func(key string) ([]byte, error)
@@ -27,30 +69,129 @@ type RetrieveFunc func(key string) ([]byte, error)
 // RetrieveFunc 实现了 retrieve 方法，即实现了 Retriver 接口
 // 使得任意匿名函数 func 通过 RetrieverFunc(func) 强制类型转换后，实现了 Retriver 接口的能力
 // 这个在 gin 框架里面的 HandlerFunc 类型封装匿名函数时也有所体现，http 类型的 handler 强制转换后直接可以作为 gin 的 Handler 使用
-func (f RetrieveFunc) retrieve(key string) ([]byte, error) {
-	return f(key)
+// 注意 RetrieveFunc 感知不到 ctx，需要随请求取消的数据源请使用 RetrieveContextFunc
+func (f RetrieveFunc) retrieve(_ context.Context, key string) ([]byte, time.Time, error) {
+	bytes, err := f(key)
+	return bytes, time.Time{}, err
+}
+
+// RetrieveContextFunc 是可以感知 ctx 的 Retriever
+// 同一个 key 的并发请求共享一次回源，ctx 只在所有等待这次回源的调用方都取消或超时之后才被取消
+type RetrieveContextFunc func(ctx context.Context, key string) ([]byte, error)
+
+func (f RetrieveContextFunc) retrieve(ctx context.Context, key string) ([]byte, time.Time, error) {
+	bytes, err := f(ctx, key)
+	return bytes, time.Time{}, err
+}
+
+// RetrieveExpireFunc 是可以为每条数据指定过期时间的 Retriever
+// 数据在 expire 之后会从缓存中失效，下次访问时重新回源；expire 为零值表示永不过期
+type RetrieveExpireFunc func(ctx context.Context, key string) (bytes []byte, expire time.Time, err error)
+
+func (f RetrieveExpireFunc) retrieve(ctx context.Context, key string) ([]byte, time.Time, error) {
+	return f(ctx, key)
+}
+
+// BatchRetriever 是可以一次从数据源取回多个 key 的 Retriever
+// GetMulti 会把本节点负责的所有未命中 key 合并成一次 retrieveMany 调用
+type BatchRetriever interface {
+	Retriever
+	retrieveMany(context.Context, []string) (map[string]Result, error)
+}
+
+// RetrieveBatchFunc 是可以批量回源的 Retriever，例如一条 SELECT ... WHERE key IN (...) 语句
+// 返回的 map 中不存在的 key 视为数据源中没有这条数据（ErrNotFound）；error 非空时整批 key 都失败
+type RetrieveBatchFunc func(ctx context.Context, keys []string) (map[string][]byte, error)
+
+func (f RetrieveBatchFunc) retrieve(ctx context.Context, key string) ([]byte, time.Time, error) {
+	values, err := f(ctx, []string{key})
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	bytes, ok := values[key]
+	if !ok {
+		return nil, time.Time{}, fmt.Errorf("%s: %w", key, ErrNotFound)
+	}
+	return bytes, time.Time{}, nil
+}
+
+func (f RetrieveBatchFunc) retrieveMany(ctx context.Context, keys []string) (map[string]Result, error) {
+	values, err := f(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	results := make(map[string]Result, len(keys))
+	for _, key := range keys {
+		if bytes, ok := values[key]; ok {
+			results[key] = Result{Value: ByteView{b: cloneBytes(bytes)}}
+		} else {
+			results[key] = Result{Err: fmt.Errorf("%s: %w", key, ErrNotFound)}
+		}
+	}
+	return results, nil
+}
+
+// Result 是批量查询中单个 key 的结果
+type Result struct {
+	Value ByteView
+	Err   error
 }
 
 // Group 提供了命名管理缓存、填充缓存的能力
 type Group struct {
 	name      string
-	cache     *cache
+	mainCache *cache // 当前节点作为 owner 负责的 key
+	hotCache  *cache // 由远端节点负责但访问频繁的 key，容量单独计算
 	retriever Retriever
 	server    Picker
 	flight    *singleflight.SingleFlight
+	// generation 是缓存的代数，每次整体失效或按前缀失效时加一；回源期间代数发生变化的数据不会写入缓存
+	generation uint64
+	// notFoundTTL 是否定条目的缓存时长，0 表示不缓存
+	notFoundTTL time.Duration
+	// failurePolicy 是 owner 请求失败时的处理策略
+	failurePolicy FailurePolicy
+	// softTTL 与 hardTTL 用于 stale-while-revalidate：条目在 softTTL 后过期但继续保留到 hardTTL，
+	// 期间的读取立即返回旧值并在后台刷新；hardTTL 不大于 softTTL 时不启用
+	softTTL, hardTTL time.Duration
+	// Stats 记录了 Group 处理请求的各项计数
+	Stats Stats
+	// log 携带 group 字段，hotLog 是它的限流版本，用于每个请求都可能触发的日志
+	log, hotLog logger.Interface
+
+	// 以下配置只在创建 Group 时使用，参见 options.go
+	policy          eviction.Factory
+	hotCacheBytes   int64
+	cacheShards     int
+	janitorInterval time.Duration
 }
 
-// NewGroup 新创建一个缓存空间
-func NewGroup(name string, maxBytes int64, retriever Retriever) *Group {
+// NewGroup 新创建一个缓存空间，maxBytes 是 mainCache 的容量，默认使用 LRU 淘汰策略
+// 可选配置参见 options.go，例如 NewGroup(name, maxBytes, retriever, WithEvictionPolicy(eviction.ARC), WithNotFoundTTL(time.Minute))
+func NewGroup(name string, maxBytes int64, retriever Retriever, opts ...GroupOption) *Group {
 	if retriever == nil {
 		panic("Group Retriver must be existed!")
 	}
 
 	g := &Group{
-		name:      name,
-		cache:     newCache(maxBytes),
-		retriever: retriever,
-		flight:    &singleflight.SingleFlight{},
+		name:            name,
+		retriever:       retriever,
+		flight:          &singleflight.SingleFlight{},
+		notFoundTTL:     defaultNotFoundTTL,
+		policy:          eviction.LRU,
+		hotCacheBytes:   maxBytes / defaultHotCacheRatio,
+		cacheShards:     defaultCacheShards,
+		janitorInterval: defaultJanitorInterval,
+	}
+	g.SetLogger(logger.Nop())
+	for _, opt := range opts {
+		opt.applyGroup(g)
+	}
+	g.mainCache = newShardedCache(maxBytes, g.cacheShards, g.policy)
+	g.hotCache = newShardedCache(g.hotCacheBytes, g.cacheShards, g.policy)
+	if g.janitorInterval > 0 {
+		g.mainCache.startJanitor(g.janitorInterval)
+		g.hotCache.startJanitor(g.janitorInterval)
 	}
 	mu.Lock()
 	groups[name] = g
@@ -58,6 +199,18 @@ func NewGroup(name string, maxBytes int64, retriever Retriever) *Group {
 	return g
 }
 
+// SetLogger 设置 Group 使用的日志，默认不输出任何日志，需要在使用 Group 之前设置
+// 日志会携带 group 字段；key 只以哈希（key_hash）的形式出现，避免把业务数据写入日志
+func (g *Group) SetLogger(l logger.Interface) {
+	g.log = l.With("group", g.name)
+	g.hotLog = logger.Sample(g.log, logSamplePeriod, logSampleFirst, logSampleThereafter)
+}
+
+// revalidating 判断是否启用了 stale-while-revalidate
+func (g *Group) revalidating() bool {
+	return g.hardTTL > g.softTTL
+}
+
 // RegisterServer 为 Group 注册 server
 func (g *Group) RegisterServer(p Picker) {
 	if g.server != nil {
@@ -76,44 +229,90 @@ func GetGroup(name string) *Group {
 func DestroryGroup(name string) {
 	g := GetGroup(name)
 	if g != nil {
-		svr := g.server.(*Server)
-		// 停止服务
-		svr.Stop()
+		// 停止后台清理协程
+		g.mainCache.close()
+		g.hotCache.close()
+		if svr, ok := g.server.(*Server); ok {
+			// 停止服务
+			svr.Stop()
+			g.log.Info("group destroyed", "addr", svr.Addr)
+		}
 
+		mu.Lock()
 		delete(groups, name)
-		logger.Logger.Info("Destrory cache [%s %s]", name, svr.Addr)
+		mu.Unlock()
 	}
 }
 
-func (g *Group) Get(key string) (ByteView, error) {
+// Get 从缓存中获取 key 对应的值，未命中时从远端节点或本地数据源加载
+// ctx 的取消和截止时间会一路传递到 singleflight、远端节点的 gRPC 请求以及 Retriever
+func (g *Group) Get(ctx context.Context, key string) (value ByteView, err error) {
 	if key == "" {
 		return ByteView{}, errors.New("key must be existed")
 	}
+	ctx, span := startSpan(ctx, "groupcache.Group.Get", trace.SpanKindInternal, attrGroup.String(g.name), keyAttr(key))
+	defer func() { endSpan(span, err) }()
 
-	if value, ok := g.cache.get(key); ok {
-		logger.Logger.Info("cache hit...")
+	g.Stats.Gets.Add(1)
+	value, ok, stale := g.lookupCache(key)
+	span.SetAttributes(attribute.Bool("groupcache.hit", ok))
+	if ok {
+		if value.nf {
+			return ByteView{}, ErrNotFound
+		}
 		return value, nil
 	}
+	if stale != nil && g.revalidating() {
+		g.Stats.StaleHits.Add(1)
+		span.SetAttributes(attribute.Bool("groupcache.stale", true))
+		g.refresh(key, stale)
+		return *stale, nil
+	}
 
 	// cache missing, get it another way
-	return g.load(key)
+	return g.load(ctx, key, stale)
 }
 
-func (g *Group) load(key string) (ByteView, error) {
-	// singleFlight
-	view, err := g.flight.Do(key, func() (interface{}, error) {
-		if g.server != nil {
-			if fetcher, ok := g.server.Pick(key); ok {
-				bytes, err := fetcher.Fetch(g.name, key)
-				if err == nil {
-					return ByteView{b: cloneBytes(bytes)}, nil
-				}
-				logger.Logger.Info("fetch key %s failed, error: %s\n", fetcher, err.Error())
+// lookupCache 依次查找 mainCache 与 hotCache，命中的可能是否定条目
+// 没有命中时，如果缓存中有已过期但仍在保留期内的旧值，通过 stale 返回
+func (g *Group) lookupCache(key string) (value ByteView, ok bool, stale *ByteView) {
+	now := time.Now()
+	if value, ok := g.mainCache.get(key); ok {
+		if !value.expired(now) {
+			g.Stats.MainHits.Add(1)
+			if g.hotLog.Enabled(logger.DebugLevel) {
+				g.hotLog.Debug("cache hit", "cache", "main", "key_hash", keyHash(key))
+			}
+			return value, true, nil
+		}
+		stale = &value
+	}
+	if value, ok := g.hotCache.get(key); ok {
+		if !value.expired(now) {
+			g.Stats.HotHits.Add(1)
+			if g.hotLog.Enabled(logger.DebugLevel) {
+				g.hotLog.Debug("cache hit", "cache", "hot", "key_hash", keyHash(key))
 			}
+			return value, true, nil
+		}
+		if stale == nil {
+			stale = &value
 		}
-		// 如果目前只有单节点，那么从本地数据库查询
-		return g.getLocally(key)
+	}
+	if stale != nil && stale.nf {
+		stale = nil
+	}
+	return ByteView{}, false, stale
+}
+
+// load 从 owner 或数据源加载 key，stale 是缓存中已过期的旧值，ServeStale 策略下作为兜底
+func (g *Group) load(ctx context.Context, key string, stale *ByteView) (ByteView, error) {
+	// singleFlight
+	ctx, span := startSpan(ctx, "groupcache.singleflight.Do", trace.SpanKindInternal, keyAttr(key))
+	view, err := g.flight.Do(ctx, key, func(ctx context.Context) (interface{}, error) {
+		return g.fetch(ctx, key, stale, false)
 	})
+	endSpan(span, err)
 
 	if err == nil {
 		return view.(ByteView), nil
@@ -121,19 +320,487 @@ func (g *Group) load(key string) (ByteView, error) {
 	return ByteView{}, err
 }
 
+// refresh 在后台重新加载 key，通过 singleflight 保证同一个 key 同时只有一个刷新在进行
+func (g *Group) refresh(key string, stale *ByteView) {
+	g.flight.DoAsync(key, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), defaultRefreshTimeout)
+		defer cancel()
+		value, err := g.fetch(ctx, key, stale, true)
+		if err != nil {
+			g.hotLog.Warn("refresh failed", "key_hash", keyHash(key), "err", err)
+		}
+		return value, err
+	})
+}
+
+// fetch 从 owner 或数据源取回 key 对应的值并填充缓存
+// refreshing 表示这是对旧值的后台刷新，远端取回的值直接写入 hotCache 替换旧值，而不是按概率写入
+func (g *Group) fetch(ctx context.Context, key string, stale *ByteView, refreshing bool) (ByteView, error) {
+	// 其他节点转发过来的请求说明本节点就是它选出的 owner，直接在本地处理，避免有界负载等策略下再次转发
+	if g.server != nil && !fromPeer(ctx) {
+		if fetcher, ok := g.server.Pick(ctx, key); ok {
+			gen := g.Generation()
+			value, err := fetcher.Fetch(ctx, g.name, key)
+			g.observeFetch(err)
+			if err == nil {
+				if refreshing {
+					g.populateCacheAt(key, value, g.hotCache, gen)
+				} else {
+					g.populateHotCache(key, value, gen)
+				}
+				return value, nil
+			}
+			// owner 已经确认数据不存在（并缓存了这个结果），不再重复回源
+			if errors.Is(err, ErrNotFound) {
+				return ByteView{}, err
+			}
+			// 调用方已经放弃了这次请求，不必再回源到本地数据库
+			if ctx.Err() != nil {
+				return ByteView{}, ctx.Err()
+			}
+			g.hotLog.Warn("fetch from peer failed", "peer", peerName(fetcher), "key_hash", keyHash(key), "err", err)
+			return g.fetchFailed(ctx, key, fetcher, stale, err, gen)
+		}
+	}
+	// 如果目前只有单节点，那么从本地数据库查询
+	value, err := g.getLocally(ctx, key)
+	if err != nil && stale != nil && g.failurePolicy == ServeStale && errors.Is(err, ErrRetrieve) {
+		g.hotLog.Warn("retrieve failed, serve stale value", "key_hash", keyHash(key), "err", err)
+		g.Stats.StaleHits.Add(1)
+		return *stale, nil
+	}
+	return value, err
+}
+
+// fetchFailed 按 failurePolicy 处理 owner 请求失败的 key，failed 是请求失败的 owner，gen 是请求开始时的缓存代数
+func (g *Group) fetchFailed(ctx context.Context, key string, failed Fetcher, stale *ByteView, err error, gen uint64) (ByteView, error) {
+	switch g.failurePolicy {
+	case NextPeer:
+		next, ok := g.server.PickNext(ctx, key, failed)
+		if !ok {
+			// 排除故障节点之后 key 由本节点负责
+			return g.getLocally(ctx, key)
+		}
+		value, err := next.Fetch(ctx, g.name, key)
+		g.observeFetch(err)
+		if err != nil {
+			return ByteView{}, err
+		}
+		g.populateHotCache(key, value, gen)
+		return value, nil
+	case ReturnError:
+		return ByteView{}, err
+	case ServeStale:
+		if stale != nil {
+			g.hotLog.Warn("fetch failed, serve stale value", "key_hash", keyHash(key), "err", err)
+			g.Stats.StaleHits.Add(1)
+			return *stale, nil
+		}
+		return ByteView{}, err
+	default:
+		return g.getLocally(ctx, key)
+	}
+}
+
+// observeFetch 按远端节点请求的结果计数，数据不存在说明远端节点正常返回了结果
+func (g *Group) observeFetch(err error) {
+	if err == nil || errors.Is(err, ErrNotFound) {
+		g.Stats.PeerLoads.Add(1)
+	} else {
+		g.Stats.PeerErrors.Add(1)
+	}
+}
+
+// Remove 删除 key 对应的缓存，数据源中的数据更新后调用
+// 1. 如果 key 由远端节点负责，先通知 owner 删除，owner 删除失败时返回错误
+// 2. 删除本节点 mainCache 与 hotCache 中的副本
+// 3. 通知其他所有节点删除它们 hotCache 中可能存在的副本，这一步尽力而为，失败只记录日志
+func (g *Group) Remove(ctx context.Context, key string) error {
+	if key == "" {
+		return errors.New("key must be existed")
+	}
+
+	var owner Fetcher
+	if g.server != nil {
+		if fetcher, ok := g.server.Pick(ctx, key); ok {
+			owner = fetcher
+			if err := owner.Remove(ctx, g.name, key); err != nil {
+				return err
+			}
+		}
+	}
+
+	g.localRemove(key)
+	g.removeFromPeers(ctx, key, owner)
+	return nil
+}
+
+// removeFromPeers 通知 owner 以外的所有远端节点删除 key，用于清理它们 hotCache 中的副本
+// 这一步尽力而为，失败只记录日志
+func (g *Group) removeFromPeers(ctx context.Context, key string, owner Fetcher) {
+	if g.server == nil {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, peer := range g.server.GetAll() {
+		if peer == owner {
+			continue
+		}
+		wg.Add(1)
+		go func(peer Fetcher) {
+			defer wg.Done()
+			if err := peer.Remove(ctx, g.name, key); err != nil {
+				g.log.Warn("remove from peer failed", "peer", peerName(peer), "key_hash", keyHash(key), "err", err)
+			}
+		}(peer)
+	}
+	wg.Wait()
+}
+
+// Set 直接写入 key 对应的值，不经过 Retriever，用于预热缓存或写穿（write-through）
+// 值会被写入 key 的 owner 的 mainCache：owner 是远端节点时通过 Set RPC 写入；
+// owner 是远端节点时删除本节点 hotCache 中的旧副本，传入 WithHotCache 时改为保留一份写入的值
+// 写入成功后通知其他节点删除它们 hotCache 中的旧副本，与 Remove 一样尽力而为
+// expire 为零值表示永不过期
+func (g *Group) Set(ctx context.Context, key string, value []byte, expire time.Time, opts ...SetOption) error {
+	if key == "" {
+		return errors.New("key must be existed")
+	}
+	var o setOptions
+	for _, opt := range opts {
+		opt.applySet(&o)
+	}
+
+	view := ByteView{b: cloneBytes(value), e: expire}
+	var owner Fetcher
+	if g.server != nil {
+		if fetcher, ok := g.server.Pick(ctx, key); ok {
+			owner = fetcher
+			if err := owner.Set(ctx, g.name, key, view); err != nil {
+				return err
+			}
+		}
+	}
+	g.hotCache.remove(key)
+	switch {
+	case owner == nil:
+		g.populateCache(key, view, g.mainCache)
+	case o.hotCache:
+		g.populateCache(key, view, g.hotCache)
+	}
+	g.removeFromPeers(ctx, key, owner)
+	return nil
+}
+
+// GetMulti 批量获取多个 key，返回每个 key 各自的结果
+// 1. 先查本节点的 mainCache 与 hotCache
+// 2. 未命中的 key 按 owner 分组，每个远端节点只发起一次 GetMany 请求
+// 3. 由本节点负责的 key（以及远端请求整体失败的 key）在本节点回源，Retriever 实现了 BatchRetriever 时合并为一次调用
+func (g *Group) GetMulti(ctx context.Context, keys []string) map[string]Result {
+	ctx, span := startSpan(ctx, "groupcache.Group.GetMulti", trace.SpanKindInternal,
+		attrGroup.String(g.name), attribute.Int("groupcache.keys", len(keys)))
+	defer span.End()
+
+	results := make(map[string]Result, len(keys))
+	stales := make(map[string]*ByteView)
+	var misses []string
+	for _, key := range keys {
+		if _, ok := results[key]; ok {
+			continue
+		}
+		if key == "" {
+			results[key] = Result{Err: errors.New("key must be existed")}
+			continue
+		}
+		g.Stats.Gets.Add(1)
+		value, ok, stale := g.lookupCache(key)
+		if ok {
+			if value.nf {
+				results[key] = Result{Err: ErrNotFound}
+			} else {
+				results[key] = Result{Value: value}
+			}
+			continue
+		}
+		if stale != nil && g.revalidating() {
+			g.Stats.StaleHits.Add(1)
+			g.refresh(key, stale)
+			results[key] = Result{Value: *stale}
+			continue
+		}
+		if stale != nil {
+			stales[key] = stale
+		}
+		// 先占位，避免重复的 key 被多次加载
+		results[key] = Result{}
+		misses = append(misses, key)
+	}
+	if len(misses) == 0 {
+		return results
+	}
+
+	var (
+		resMu sync.Mutex
+		wg    sync.WaitGroup
+		local []string
+	)
+	owners := make(map[Fetcher][]string)
+	for _, key := range misses {
+		if g.server != nil && !fromPeer(ctx) {
+			if fetcher, ok := g.server.Pick(ctx, key); ok {
+				owners[fetcher] = append(owners[fetcher], key)
+				continue
+			}
+		}
+		local = append(local, key)
+	}
+
+	gen := g.Generation()
+	for fetcher, ownerKeys := range owners {
+		wg.Add(1)
+		go func(fetcher Fetcher, ownerKeys []string) {
+			defer wg.Done()
+			fetched, err := fetcher.FetchMany(ctx, g.name, ownerKeys)
+			if err != nil {
+				g.Stats.PeerErrors.Add(1)
+			} else {
+				g.Stats.PeerLoads.Add(int64(len(ownerKeys)))
+			}
+			if err != nil && ctx.Err() == nil {
+				g.hotLog.Warn("fetch many from peer failed", "peer", peerName(fetcher), "keys", len(ownerKeys), "err", err)
+				// 本地回源时合并成一次批量回源
+				if g.failurePolicy == FallbackLocal {
+					resMu.Lock()
+					local = append(local, ownerKeys...)
+					resMu.Unlock()
+					return
+				}
+			}
+
+			partial := make(map[string]Result, len(ownerKeys))
+			for _, key := range ownerKeys {
+				var result Result
+				switch {
+				case err != nil && ctx.Err() != nil:
+					result = Result{Err: ctx.Err()}
+				case err != nil:
+					value, err := g.fetchFailed(ctx, key, fetcher, stales[key], err, gen)
+					result = Result{Value: value, Err: err}
+				default:
+					var ok bool
+					if result, ok = fetched[key]; !ok {
+						result = Result{Err: fmt.Errorf("%s missing from peer response", key)}
+					}
+					if result.Err == nil {
+						g.populateHotCache(key, result.Value, gen)
+					}
+				}
+				partial[key] = result
+			}
+			resMu.Lock()
+			for key, result := range partial {
+				results[key] = result
+			}
+			resMu.Unlock()
+		}(fetcher, ownerKeys)
+	}
+	wg.Wait()
+
+	for key, result := range g.getManyLocally(ctx, local) {
+		results[key] = result
+	}
+	return results
+}
+
+// getManyLocally 在本节点为多个 key 回源并填充 mainCache
+// Retriever 不支持批量回源时，逐个 key 通过 singleflight 并发回源
+func (g *Group) getManyLocally(ctx context.Context, keys []string) map[string]Result {
+	results := make(map[string]Result, len(keys))
+	if len(keys) == 0 {
+		return results
+	}
+	if err := ctx.Err(); err != nil {
+		for _, key := range keys {
+			results[key] = Result{Err: err}
+		}
+		return results
+	}
+
+	if br, ok := g.retriever.(BatchRetriever); ok {
+		gen := g.Generation()
+		g.Stats.RetrieverLoads.Add(int64(len(keys)))
+		rctx, span := startSpan(ctx, "groupcache.Retriever.retrieveMany", trace.SpanKindInternal,
+			attrGroup.String(g.name), attribute.Int("groupcache.keys", len(keys)))
+		fetched, err := br.retrieveMany(rctx, keys)
+		endSpan(span, err)
+		for _, key := range keys {
+			if err != nil {
+				g.Stats.RetrieverErrors.Add(1)
+				results[key] = Result{Err: wrapRetrieveError(err)}
+				continue
+			}
+			result := fetched[key]
+			result.Err = wrapRetrieveError(result.Err)
+			if errors.Is(result.Err, ErrRetrieve) {
+				g.Stats.RetrieverErrors.Add(1)
+			}
+			if result.Err == nil {
+				result.Value = g.withSoftExpire(result.Value)
+			}
+			if result.Err == nil {
+				g.populateCacheAt(key, result.Value, g.mainCache, gen)
+			} else if errors.Is(result.Err, ErrNotFound) {
+				g.populateNotFound(key, gen)
+			}
+			results[key] = result
+		}
+		return results
+	}
+
+	var (
+		resMu sync.Mutex
+		wg    sync.WaitGroup
+	)
+	for _, key := range keys {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			view, err := g.flight.Do(ctx, key, func(ctx context.Context) (interface{}, error) {
+				return g.getLocally(ctx, key)
+			})
+			result := Result{Err: err}
+			if err == nil {
+				result.Value = view.(ByteView)
+			}
+			resMu.Lock()
+			results[key] = result
+			resMu.Unlock()
+		}(key)
+	}
+	wg.Wait()
+	return results
+}
+
+// localRemove 删除本节点 mainCache 与 hotCache 中的 key
+func (g *Group) localRemove(key string) {
+	g.mainCache.remove(key)
+	g.hotCache.remove(key)
+}
+
 // getLocally 向 Retriever 取回数据并填充至缓存中
-func (g *Group) getLocally(key string) (ByteView, error) {
-	bytes, err := g.retriever.retrieve(key)
+func (g *Group) getLocally(ctx context.Context, key string) (ByteView, error) {
+	if err := ctx.Err(); err != nil {
+		return ByteView{}, err
+	}
+	gen := g.Generation()
+	g.Stats.RetrieverLoads.Add(1)
+	rctx, span := startSpan(ctx, "groupcache.Retriever.retrieve", trace.SpanKindInternal, attrGroup.String(g.name), keyAttr(key))
+	bytes, expire, err := g.retriever.retrieve(rctx, key)
+	endSpan(span, err)
 	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			g.populateNotFound(key, gen)
+		}
+		err = wrapRetrieveError(err)
+		if errors.Is(err, ErrRetrieve) {
+			g.Stats.RetrieverErrors.Add(1)
+		}
 		return ByteView{}, err
 	}
 
-	value := ByteView{b: cloneBytes(bytes)}
-	g.populateCache(key, value)
+	value := g.withSoftExpire(ByteView{b: cloneBytes(bytes), e: expire})
+	// 回源期间 Group 被整体失效，取回的可能是迁移前的旧数据，不再写入缓存
+	g.populateCacheAt(key, value, g.mainCache, gen)
 	return value, nil
 }
 
-// populateCache 将从底层数据库中查询到的数据填充到缓存中
-func (g *Group) populateCache(key string, value ByteView) {
-	g.cache.put(key, value)
+// Generation 返回 Group 当前的缓存代数
+func (g *Group) Generation() uint64 {
+	return atomic.LoadUint64(&g.generation)
+}
+
+// invalidatePrefix 删除本节点 mainCache 与 hotCache 中所有以 prefix 开头的 key
+// 与 bumpGeneration 一样先递增代数再删除，进行中的加载取回的可能是失效前的旧数据，不会再写入缓存
+func (g *Group) invalidatePrefix(prefix string) {
+	gen := atomic.AddUint64(&g.generation, 1)
+	n := g.mainCache.removePrefix(prefix) + g.hotCache.removePrefix(prefix)
+	g.log.Info("invalidate prefix", "prefix", prefix, "removed", n, "generation", gen)
+}
+
+// bumpGeneration 递增缓存代数并清空本节点的全部缓存
+func (g *Group) bumpGeneration() {
+	gen := atomic.AddUint64(&g.generation, 1)
+	g.mainCache.clear()
+	g.hotCache.clear()
+	g.log.Info("bump generation", "generation", gen)
+}
+
+// withSoftExpire 为数据源中没有指定过期时间的数据设置 softTTL
+func (g *Group) withSoftExpire(value ByteView) ByteView {
+	if g.revalidating() && g.softTTL > 0 && value.e.IsZero() {
+		value.e = time.Now().Add(g.softTTL)
+	}
+	return value
+}
+
+// staleRetention 返回条目过期之后继续保留在缓存中的时长
+// stale-while-revalidate 保留 hardTTL-softTTL，ServeStale 策略至少保留 defaultStaleTTL，owner 不可用时作为旧值返回
+func (g *Group) staleRetention() time.Duration {
+	var d time.Duration
+	if g.revalidating() {
+		d = g.hardTTL - g.softTTL
+	}
+	if g.failurePolicy == ServeStale && d < defaultStaleTTL {
+		d = defaultStaleTTL
+	}
+	return d
+}
+
+// populateCache 将查询到的数据填充到指定的缓存中，过期的条目按 staleRetention 继续保留
+func (g *Group) populateCache(key string, value ByteView, c *cache) {
+	c.putWithExpire(key, value, g.retainUntil(value))
+}
+
+// populateCacheAt 与 populateCache 相同，但只在缓存代数仍为 gen 时写入
+// 代数在分片锁内检查：bumpGeneration 先递增代数再逐个清空分片，与它并发的写入要么随后被清空，要么看到新的代数而放弃
+func (g *Group) populateCacheAt(key string, value ByteView, c *cache, gen uint64) {
+	c.putWithExpireIf(key, value, g.retainUntil(value), func() bool {
+		return g.Generation() == gen
+	})
+}
+
+// retainUntil 返回条目在缓存中保留的截止时间
+func (g *Group) retainUntil(value ByteView) time.Time {
+	expire := value.Expire()
+	if !expire.IsZero() && !value.nf {
+		expire = expire.Add(g.staleRetention())
+	}
+	return expire
+}
+
+// populateHotCache 只保留一部分远端取回的值，避免 hotCache 被冷数据占满，gen 是请求开始时的缓存代数
+func (g *Group) populateHotCache(key string, value ByteView, gen uint64) {
+	if rand.Intn(hotCacheOdds) == 0 {
+		g.populateCacheAt(key, value, g.hotCache, gen)
+	}
+}
+
+// populateNotFound 在 mainCache 中写入一个否定条目，notFoundTTL 之后过期，gen 是回源开始时的缓存代数
+func (g *Group) populateNotFound(key string, gen uint64) {
+	if g.notFoundTTL <= 0 {
+		return
+	}
+	g.populateCacheAt(key, ByteView{e: time.Now().Add(g.notFoundTTL), nf: true}, g.mainCache, gen)
+}
+
+// CacheStats 返回 Group 中指定缓存的统计信息
+func (g *Group) CacheStats(which CacheType) CacheStats {
+	switch which {
+	case MainCache:
+		return g.mainCache.stats()
+	case HotCache:
+		return g.hotCache.stats()
+	default:
+		return CacheStats{}
+	}
 }
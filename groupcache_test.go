@@ -0,0 +1,548 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGetMultiBatchRetriever(t *testing.T) {
+	calls := 0
+	db := map[string]string{"Tom": "630", "Jack": "589", "Sam": "567"}
+	g := NewGroup("multi", 2<<10, RetrieveBatchFunc(func(ctx context.Context, keys []string) (map[string][]byte, error) {
+		calls++
+		values := make(map[string][]byte, len(keys))
+		for _, key := range keys {
+			if v, ok := db[key]; ok {
+				values[key] = []byte(v)
+			}
+		}
+		return values, nil
+	}))
+	defer DestroryGroup("multi")
+
+	ctx := context.Background()
+	results := g.GetMulti(ctx, []string{"Tom", "Jack", "Tom", "unknown"})
+	if calls != 1 {
+		t.Fatalf("expect misses to be retrieved in one batch, but got %d calls", calls)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expect 3 distinct results, but got %d", len(results))
+	}
+	for _, key := range []string{"Tom", "Jack"} {
+		if r := results[key]; r.Err != nil || r.Value.String() != db[key] {
+			t.Fatalf("unexpected result for %s: %v %v", key, r.Value, r.Err)
+		}
+	}
+	if results["unknown"].Err == nil {
+		t.Fatal("expect error for unknown key")
+	}
+
+	// 第二次查询命中缓存，只有不存在的 key 需要回源
+	g.GetMulti(ctx, []string{"Tom", "Jack", "Sam", "unknown"})
+	if calls != 2 {
+		t.Fatalf("expect one more batch call, but got %d calls", calls)
+	}
+	if _, err := g.Get(ctx, "Sam"); err != nil || calls != 2 {
+		t.Fatalf("expect Sam to be cached, err %v calls %d", err, calls)
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	calls := 0
+	g := NewGroup("negative", 2<<10, RetrieveFunc(func(key string) ([]byte, error) {
+		calls++
+		return nil, fmt.Errorf("student %s: %w", key, ErrNotFound)
+	}))
+	defer DestroryGroup("negative")
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if _, err := g.Get(ctx, "nobody"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expect ErrNotFound, but got %v", err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("expect not-found result to be cached, but retriever called %d times", calls)
+	}
+
+	// 否定条目过期后重新回源
+	g.notFoundTTL = 10 * time.Millisecond
+	g.Get(ctx, "someone")
+	time.Sleep(20 * time.Millisecond)
+	g.Get(ctx, "someone")
+	if calls != 3 {
+		t.Fatalf("expect negative entry to expire, but retriever called %d times", calls)
+	}
+
+	// 通过 rpc 查询时远端调用方同样得到 ErrNotFound
+	s, err := NewServer("localhost:9999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, s)
+	if _, err := c.Fetch(ctx, "negative", "nobody"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expect ErrNotFound from peer, but got %v", err)
+	}
+	results, err := c.FetchMany(ctx, "negative", []string{"nobody"})
+	if err != nil || !errors.Is(results["nobody"].Err, ErrNotFound) {
+		t.Fatalf("expect ErrNotFound from peer batch, but got %v %v", results, err)
+	}
+}
+
+// fakeFetcher 是用于测试的 Fetcher，err 非空时所有请求都失败，Remove 与 Set 会被记录下来
+type fakeFetcher struct {
+	value string
+	err   error
+
+	mu      sync.Mutex
+	removed []string
+	sets    map[string]ByteView
+}
+
+func (f *fakeFetcher) Fetch(ctx context.Context, group, key string) (ByteView, error) {
+	if f.err != nil {
+		return ByteView{}, f.err
+	}
+	return ByteView{b: []byte(f.value)}, nil
+}
+
+func (f *fakeFetcher) FetchMany(ctx context.Context, group string, keys []string) (map[string]Result, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	results := make(map[string]Result, len(keys))
+	for _, key := range keys {
+		results[key] = Result{Value: ByteView{b: []byte(f.value)}}
+	}
+	return results, nil
+}
+
+func (f *fakeFetcher) Remove(ctx context.Context, group, key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.removed = append(f.removed, key)
+	return f.err
+}
+
+func (f *fakeFetcher) Set(ctx context.Context, group, key string, value ByteView) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	if f.sets == nil {
+		f.sets = make(map[string]ByteView)
+	}
+	f.sets[key] = value
+	return nil
+}
+
+func (f *fakeFetcher) removedKeys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.removed...)
+}
+
+// fakePicker 把所有 key 都交给 owner（为 nil 时表示由本节点负责），PickNext 返回 next（为 nil 时表示由本节点负责）
+// others 是除 owner 以外的其他远端节点
+type fakePicker struct {
+	owner, next Fetcher
+	others      []Fetcher
+}
+
+func (p *fakePicker) Pick(ctx context.Context, key string) (Fetcher, bool) {
+	return p.owner, p.owner != nil
+}
+
+func (p *fakePicker) PickNext(ctx context.Context, key string, failed Fetcher) (Fetcher, bool) {
+	return p.next, p.next != nil
+}
+
+func (p *fakePicker) GetAll() []Fetcher {
+	if p.owner == nil {
+		return p.others
+	}
+	return append([]Fetcher{p.owner}, p.others...)
+}
+
+func TestFailurePolicy(t *testing.T) {
+	errPeer := fmt.Errorf("could not get from peer: %w", ErrPeerUnavailable)
+	tests := []struct {
+		policy  FailurePolicy
+		next    Fetcher
+		want    string
+		wantErr bool
+		calls   int
+	}{
+		{FallbackLocal, nil, "db", false, 1},
+		{NextPeer, &fakeFetcher{value: "next"}, "next", false, 0},
+		{NextPeer, nil, "db", false, 1},
+		{NextPeer, &fakeFetcher{err: errPeer}, "", true, 0},
+		{ReturnError, nil, "", true, 0},
+		{ServeStale, nil, "", true, 0},
+	}
+	for i, tt := range tests {
+		calls := 0
+		name := fmt.Sprintf("policy%d", i)
+		g := NewGroup(name, 2<<10, RetrieveFunc(func(key string) ([]byte, error) {
+			calls++
+			return []byte("db"), nil
+		}), WithFailurePolicy(tt.policy))
+		g.RegisterServer(&fakePicker{owner: &fakeFetcher{err: errPeer}, next: tt.next})
+
+		view, err := g.Get(context.Background(), "Tom")
+		if (err != nil) != tt.wantErr || view.String() != tt.want || calls != tt.calls {
+			t.Errorf("case %d: got (%q, %v) with %d retriever calls, expect %q, error %v, %d calls",
+				i, view.String(), err, calls, tt.want, tt.wantErr, tt.calls)
+		}
+		if tt.wantErr && !errors.Is(err, ErrPeerUnavailable) {
+			t.Errorf("case %d: expect peer error, but got %v", i, err)
+		}
+		DestroryGroup(name)
+	}
+}
+
+func TestServeStale(t *testing.T) {
+	g := NewGroup("stale", 2<<10, RetrieveFunc(func(key string) ([]byte, error) {
+		return nil, errors.New("db down")
+	}), WithFailurePolicy(ServeStale))
+	defer DestroryGroup("stale")
+	owner := &fakeFetcher{value: "630"}
+	g.RegisterServer(&fakePicker{owner: owner})
+
+	// 旧值在逻辑过期后仍保留在缓存中
+	g.populateCache("Tom", ByteView{b: []byte("630"), e: time.Now().Add(-time.Second)}, g.mainCache)
+	owner.err = ErrPeerUnavailable
+	view, err := g.Get(context.Background(), "Tom")
+	if err != nil || view.String() != "630" {
+		t.Fatalf("expect stale value 630, but got %q %v", view.String(), err)
+	}
+
+	// owner 恢复后返回新值
+	owner.err, owner.value = nil, "631"
+	if view, err := g.Get(context.Background(), "Tom"); err != nil || view.String() != "631" {
+		t.Fatalf("expect fresh value 631, but got %q %v", view.String(), err)
+	}
+
+	// 本节点作为 owner 回源失败时同样返回旧值
+	local := NewGroup("stale-local", 2<<10, RetrieveFunc(func(key string) ([]byte, error) {
+		return nil, errors.New("db down")
+	}), WithFailurePolicy(ServeStale))
+	defer DestroryGroup("stale-local")
+	local.populateCache("Tom", ByteView{b: []byte("630"), e: time.Now().Add(-time.Second)}, local.mainCache)
+	if view, err := local.Get(context.Background(), "Tom"); err != nil || view.String() != "630" {
+		t.Fatalf("expect stale value 630 from local group, but got %q %v", view.String(), err)
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	g := NewGroup("swr", 2<<10, RetrieveFunc(func(key string) ([]byte, error) {
+		n := atomic.AddInt32(&calls, 1)
+		if n > 1 {
+			<-release
+		}
+		return []byte(fmt.Sprintf("v%d", n)), nil
+	}), WithStaleWhileRevalidate(20*time.Millisecond, time.Hour))
+	defer DestroryGroup("swr")
+
+	ctx := context.Background()
+	if view, _ := g.Get(ctx, "Tom"); view.String() != "v1" {
+		t.Fatalf("expect v1, but got %s", view.String())
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	// 过期之后立即返回旧值，后台刷新被阻塞期间的并发读取不会触发新的回源
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if view, err := g.Get(ctx, "Tom"); err != nil || view.String() != "v1" {
+				t.Errorf("expect stale v1, but got %s %v", view.String(), err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(release)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if view, _ := g.Get(ctx, "Tom"); view.String() == "v2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expect background refresh to populate v2")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatalf("expect exactly one background refresh, but retriever called %d times", n)
+	}
+}
+
+func TestLeaderCancel(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	g := NewGroup("leader-cancel", 2<<10, RetrieveContextFunc(func(ctx context.Context, key string) ([]byte, error) {
+		close(started)
+		<-release
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return []byte("630"), nil
+	}))
+	defer DestroryGroup("leader-cancel")
+
+	// 发起回源的请求先取消，共享这次回源的其他请求仍然得到结果
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan error, 1)
+	go func() {
+		_, err := g.Get(ctx, "Tom")
+		leader <- err
+	}()
+	<-started
+	waiter := make(chan string, 1)
+	go func() {
+		view, err := g.Get(context.Background(), "Tom")
+		if err != nil {
+			t.Errorf("expect waiter to get the value, but got %v", err)
+		}
+		waiter <- view.String()
+	}()
+	for g.flight.Dups() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	if err := <-leader; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expect leader to return context.Canceled, but got %v", err)
+	}
+	close(release)
+	if v := <-waiter; v != "630" {
+		t.Fatalf("expect 630, but got %q", v)
+	}
+}
+
+// deadlineFetcher 记录 Fetch 收到的 ctx 的截止时间
+type deadlineFetcher struct {
+	fakeFetcher
+	deadline chan time.Time
+}
+
+func (f *deadlineFetcher) Fetch(ctx context.Context, group, key string) (ByteView, error) {
+	deadline, _ := ctx.Deadline()
+	f.deadline <- deadline
+	return f.fakeFetcher.Fetch(ctx, group, key)
+}
+
+func TestDeadlinePropagation(t *testing.T) {
+	retrieved := make(chan time.Time, 1)
+	g := NewGroup("deadline", 2<<10, RetrieveContextFunc(func(ctx context.Context, key string) ([]byte, error) {
+		deadline, _ := ctx.Deadline()
+		retrieved <- deadline
+		return []byte("630"), nil
+	}))
+	defer DestroryGroup("deadline")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	want, _ := ctx.Deadline()
+	if _, err := g.Get(ctx, "Tom"); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-retrieved; !got.Equal(want) {
+		t.Fatalf("expect retriever deadline %v, but got %v", want, got)
+	}
+
+	// 远端请求同样带着调用方的截止时间
+	fetcher := &deadlineFetcher{fakeFetcher: fakeFetcher{value: "peer"}, deadline: make(chan time.Time, 1)}
+	g.RegisterServer(&fakePicker{owner: fetcher})
+	if _, err := g.Get(ctx, "Jack"); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-fetcher.deadline; !got.Equal(want) {
+		t.Fatalf("expect fetcher deadline %v, but got %v", want, got)
+	}
+}
+
+func TestBumpGenerationDuringLoad(t *testing.T) {
+	g := NewGroup("generation", 2<<10, RetrieveFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}))
+	defer DestroryGroup("generation")
+
+	// 回源结束时代数尚未变化，写入缓存之前 bumpGeneration 递增了代数并清空了分片
+	gen := g.Generation()
+	s := g.mainCache.shard("Tom")
+	s.mu.Lock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		g.populateCacheAt("Tom", ByteView{b: []byte("old")}, g.mainCache, gen)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	atomic.AddUint64(&g.generation, 1)
+	s.mu.Unlock()
+	<-done
+	if view, ok := g.mainCache.get("Tom"); ok {
+		t.Fatalf("expect value loaded before bump not to be cached, but got %s", view.String())
+	}
+
+	g.populateCacheAt("Tom", ByteView{b: []byte("new")}, g.mainCache, g.Generation())
+	if view, ok := g.mainCache.get("Tom"); !ok || view.String() != "new" {
+		t.Fatalf("expect value of current generation to be cached, but got %q", view.String())
+	}
+}
+
+// hookFetcher 在返回远端节点的结果之前调用 onFetch
+type hookFetcher struct {
+	*fakeFetcher
+	onFetch func()
+}
+
+func (f *hookFetcher) Fetch(ctx context.Context, group, key string) (ByteView, error) {
+	f.onFetch()
+	return f.fakeFetcher.Fetch(ctx, group, key)
+}
+
+func TestInvalidatePrefixDuringLoad(t *testing.T) {
+	var g *Group
+	g = NewGroup("invalidate-load", 2<<10, RetrieveFunc(func(key string) ([]byte, error) {
+		// 回源期间 key 被按前缀失效，取回的是失效前的旧数据
+		g.invalidatePrefix("user:")
+		return []byte("old"), nil
+	}))
+	defer DestroryGroup("invalidate-load")
+
+	if view, err := g.Get(context.Background(), "user:1"); err != nil || view.String() != "old" {
+		t.Fatalf("expect old, but got %q %v", view.String(), err)
+	}
+	if view, ok := g.mainCache.get("user:1"); ok {
+		t.Fatalf("expect value loaded before invalidation not to be cached, but got %s", view.String())
+	}
+
+	// 远端节点取回的值同样不会写入 hotCache
+	g.RegisterServer(&fakePicker{owner: &hookFetcher{
+		fakeFetcher: &fakeFetcher{value: "old"},
+		onFetch:     func() { g.invalidatePrefix("user:") },
+	}})
+	if _, err := g.fetch(context.Background(), "user:2", nil, true); err != nil {
+		t.Fatal(err)
+	}
+	if view, ok := g.hotCache.get("user:2"); ok {
+		t.Fatalf("expect value fetched before invalidation not to be cached, but got %s", view.String())
+	}
+}
+
+func TestGroupRemove(t *testing.T) {
+	g := NewGroup("remove", 2<<10, RetrieveFunc(func(key string) ([]byte, error) {
+		return []byte("db"), nil
+	}))
+	defer DestroryGroup("remove")
+	owner, other := &fakeFetcher{}, &fakeFetcher{err: errors.New("peer down")}
+	g.RegisterServer(&fakePicker{owner: owner, others: []Fetcher{other}})
+	ctx := context.Background()
+
+	// 1. owner 收到删除请求 2. 本节点的 hotCache 副本被删除 3. 其他节点收到删除请求，失败只记录日志
+	g.populateCache("Tom", ByteView{b: []byte("old")}, g.hotCache)
+	if err := g.Remove(ctx, "Tom"); err != nil {
+		t.Fatalf("expect remove to ignore broadcast failures, but got %v", err)
+	}
+	if got := owner.removedKeys(); len(got) != 1 || got[0] != "Tom" {
+		t.Fatalf("expect owner to remove Tom once, but got %v", got)
+	}
+	if got := other.removedKeys(); len(got) != 1 || got[0] != "Tom" {
+		t.Fatalf("expect other peer to remove its hot copy, but got %v", got)
+	}
+	if _, ok := g.hotCache.get("Tom"); ok {
+		t.Fatal("expect local hot copy to be removed")
+	}
+
+	// owner 删除失败时返回错误，本节点的副本保留，也不再广播
+	failing, bystander := &fakeFetcher{err: fmt.Errorf("could not delete: %w", ErrPeerUnavailable)}, &fakeFetcher{}
+	g.server = &fakePicker{owner: failing, others: []Fetcher{bystander}}
+	g.populateCache("Jack", ByteView{b: []byte("old")}, g.hotCache)
+	if err := g.Remove(ctx, "Jack"); !errors.Is(err, ErrPeerUnavailable) {
+		t.Fatalf("expect owner failure to be returned, but got %v", err)
+	}
+	if _, ok := g.hotCache.get("Jack"); !ok {
+		t.Fatal("expect local hot copy to be kept when owner failed")
+	}
+	if got := bystander.removedKeys(); len(got) != 0 {
+		t.Fatalf("expect no broadcast when owner failed, but got %v", got)
+	}
+}
+
+func TestGroupSet(t *testing.T) {
+	calls := 0
+	g := NewGroup("set", 2<<10, RetrieveFunc(func(key string) ([]byte, error) {
+		calls++
+		return []byte("db"), nil
+	}))
+	defer DestroryGroup("set")
+	ctx := context.Background()
+
+	// 本节点是 owner：写入 mainCache，通知其他节点删除旧副本
+	peer := &fakeFetcher{}
+	g.RegisterServer(&fakePicker{others: []Fetcher{peer}})
+	if err := g.Set(ctx, "Tom", []byte("630"), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if view, err := g.Get(ctx, "Tom"); err != nil || view.String() != "630" || calls != 0 {
+		t.Fatalf("expect Tom from mainCache, but got %q %v with %d retrieves", view.String(), err, calls)
+	}
+	if got := peer.removedKeys(); len(got) != 1 || got[0] != "Tom" {
+		t.Fatalf("expect peers to drop their hot copy, but got %v", got)
+	}
+
+	// owner 是远端节点：写入 owner，本节点的旧副本被删除，后续 Get 不会读到旧值
+	owner, other := &fakeFetcher{value: "589"}, &fakeFetcher{}
+	g.server = &fakePicker{owner: owner, others: []Fetcher{other}}
+	g.populateCache("Jack", ByteView{b: []byte("old")}, g.hotCache)
+	if err := g.Set(ctx, "Jack", []byte("589"), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := owner.sets["Jack"]; !ok || got.String() != "589" {
+		t.Fatalf("expect owner to receive Jack, but got %v", owner.sets)
+	}
+	if _, ok := g.hotCache.get("Jack"); ok {
+		t.Fatal("expect stale hot copy to be removed")
+	}
+	if view, err := g.Get(ctx, "Jack"); err != nil || view.String() != "589" {
+		t.Fatalf("expect Jack from owner, but got %q %v", view.String(), err)
+	}
+	if got := other.removedKeys(); len(got) != 1 || got[0] != "Jack" {
+		t.Fatalf("expect other peers to drop their hot copy, but got %v", got)
+	}
+	if got := owner.removedKeys(); len(got) != 0 {
+		t.Fatalf("expect owner not to be asked to remove, but got %v", got)
+	}
+
+	// hotCache 为 true 时在本节点保留新值的副本
+	if err := g.Set(ctx, "Sam", []byte("567"), time.Time{}, WithHotCache()); err != nil {
+		t.Fatal(err)
+	}
+	if view, ok := g.hotCache.get("Sam"); !ok || view.String() != "567" {
+		t.Fatalf("expect Sam in hotCache, but got %q %v", view.String(), ok)
+	}
+
+	// owner 写入失败时返回错误，不通知其他节点
+	failing, bystander := &fakeFetcher{err: fmt.Errorf("could not set: %w", ErrPeerUnavailable)}, &fakeFetcher{}
+	g.server = &fakePicker{owner: failing, others: []Fetcher{bystander}}
+	if err := g.Set(ctx, "Lily", []byte("600"), time.Time{}, WithHotCache()); !errors.Is(err, ErrPeerUnavailable) {
+		t.Fatalf("expect owner failure to be returned, but got %v", err)
+	}
+	if _, ok := g.hotCache.get("Lily"); ok {
+		t.Fatal("expect nothing cached when owner failed")
+	}
+	if got := bystander.removedKeys(); len(got) != 0 {
+		t.Fatalf("expect no broadcast when owner failed, but got %v", got)
+	}
+}
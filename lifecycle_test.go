@@ -0,0 +1,242 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/1055373165/groupcache/groupcachepb"
+	"github.com/1055373165/groupcache/logger"
+	"github.com/charmbracelet/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// fakeRegistry 按顺序记录注册与注销，测试不依赖 etcd
+type fakeRegistry struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *fakeRegistry) Register(_ context.Context, addr string, _ int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, "register "+addr)
+	return nil
+}
+
+func (r *fakeRegistry) Deregister(_ context.Context, addr string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, "deregister "+addr)
+	return nil
+}
+
+func (r *fakeRegistry) last() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.events) == 0 {
+		return ""
+	}
+	return r.events[len(r.events)-1]
+}
+
+// freeAddr 返回一个当前空闲的本地地址
+func freeAddr(t *testing.T) string {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+	return "localhost:" + port
+}
+
+// dialTestClient 通过 TCP 连接到 addr 上的 Server
+func dialTestClient(t *testing.T, addr string) *client {
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &client{name: addr, conn: conn, grpcCli: pb.NewGroupCacheClient(conn), log: logger.Nop(), fetchTimeout: defaultFetchTimeout}
+}
+
+func TestServerLifecycle(t *testing.T) {
+	NewGroup("lifecycle", 2<<10, RetrieveFunc(func(key string) ([]byte, error) {
+		return []byte("v-" + key), nil
+	}))
+	defer DestroryGroup("lifecycle")
+
+	addr := freeAddr(t)
+	reg := &fakeRegistry{}
+	s, err := NewServer(addr, WithRegistry(reg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// 反复启动和停止，每一轮都能正常提供服务
+	for i := 0; i < 3; i++ {
+		ready := s.Ready()
+		if err := s.Start(ctx); err != nil {
+			t.Fatalf("round %d: start failed: %v", i, err)
+		}
+		select {
+		case <-ready:
+		default:
+			t.Fatalf("round %d: expect ready to be closed after Start returned", i)
+		}
+		if err := s.Start(ctx); err == nil {
+			t.Fatalf("round %d: expect starting a running server to fail", i)
+		}
+		if got := reg.last(); got != "register "+addr {
+			t.Fatalf("round %d: expect server to be registered, but got %q", i, got)
+		}
+
+		view, err := dialTestClient(t, addr).Fetch(ctx, "lifecycle", "k")
+		if err != nil || view.String() != "v-k" {
+			t.Fatalf("round %d: unexpected fetch result %q %v", i, view.String(), err)
+		}
+
+		if err := s.Shutdown(ctx); err != nil {
+			t.Fatalf("round %d: shutdown failed: %v", i, err)
+		}
+		if got := reg.last(); got != "deregister "+addr {
+			t.Fatalf("round %d: expect server to be deregistered, but got %q", i, got)
+		}
+		select {
+		case <-s.Ready():
+			t.Fatalf("round %d: expect a fresh ready channel after Shutdown", i)
+		default:
+		}
+	}
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown a stopped server should be a no-op, but got %v", err)
+	}
+
+	// Shutdown 之后同步节点的协程必须退出
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		buf := make([]byte, 1<<20)
+		stacks := string(buf[:runtime.Stack(buf, true)])
+		if !strings.Contains(stacks, "(*Server).watchPeers") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("watchPeers goroutine leaked after Shutdown")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShutdownDrainsInflight(t *testing.T) {
+	entered, release := make(chan struct{}), make(chan struct{})
+	NewGroup("drain", 2<<10, RetrieveFunc(func(key string) ([]byte, error) {
+		close(entered)
+		<-release
+		return []byte("v-" + key), nil
+	}))
+	defer DestroryGroup("drain")
+
+	addr := freeAddr(t)
+	reg := &fakeRegistry{}
+	s, err := NewServer(addr, WithRegistry(reg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		view ByteView
+		err  error
+	}
+	fetched := make(chan result, 1)
+	go func() {
+		view, err := dialTestClient(t, addr).Fetch(ctx, "drain", "k")
+		fetched <- result{view, err}
+	}()
+	<-entered
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- s.Shutdown(ctx) }()
+
+	// 先注销，再等待进行中的请求
+	for reg.last() != "deregister "+addr {
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case err := <-stopped:
+		t.Fatalf("expect shutdown to wait for in-flight request, but returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if r := <-fetched; r.err != nil || r.view.String() != "v-k" {
+		t.Fatalf("expect in-flight request to complete, but got %q %v", r.view.String(), r.err)
+	}
+	if err := <-stopped; err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	entered, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	NewGroup("drain-timeout", 2<<10, RetrieveContextFunc(func(ctx context.Context, key string) ([]byte, error) {
+		close(entered)
+		select {
+		case <-release:
+		case <-ctx.Done():
+		}
+		return nil, ctx.Err()
+	}))
+	defer DestroryGroup("drain-timeout")
+
+	addr := freeAddr(t)
+	s, err := NewServer(addr, WithRegistry(&fakeRegistry{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	fetched := make(chan error, 1)
+	go func() {
+		_, err := dialTestClient(t, addr).Fetch(context.Background(), "drain-timeout", "k")
+		fetched <- err
+	}()
+	<-entered
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect shutdown to give up after ctx deadline, but got %v", err)
+	}
+	if err := <-fetched; err == nil {
+		t.Fatal("expect in-flight request to be aborted by forced stop")
+	}
+}
+
+func TestRegistryLogger(t *testing.T) {
+	s, err := NewServer("localhost:9999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// NewServer 之后设置的日志同样作用于默认的 etcd 注册
+	var buf strings.Builder
+	s.SetLogger(logger.New(log.New(&buf)))
+	s.registry.(*etcdRegistry).log.Warn("lease lost")
+	if out := buf.String(); !strings.Contains(out, "lease lost") || !strings.Contains(out, "addr=localhost:9999") {
+		t.Fatalf("expect registry to log through server logger, but got %q", out)
+	}
+}
@@ -0,0 +1,85 @@
+package logger
+
+import (
+	"github.com/charmbracelet/log"
+)
+
+// Level 是日志级别
+type Level int
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+// Interface 是结构化日志接口，keyvals 是交替出现的字段名与字段值
+// Enabled 用于在热路径上先判断级别，避免在日志被丢弃时仍然构造字段
+type Interface interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+	// With 返回一个每条日志都携带 keyvals 的新 Interface
+	With(keyvals ...interface{}) Interface
+	Enabled(level Level) bool
+}
+
+// Nop 返回丢弃所有日志的 Interface，这是 Group 与 Server 的默认日志
+func Nop() Interface {
+	return nop{}
+}
+
+type nop struct{}
+
+func (nop) Debug(string, ...interface{})    {}
+func (nop) Info(string, ...interface{})     {}
+func (nop) Warn(string, ...interface{})     {}
+func (nop) Error(string, ...interface{})    {}
+func (n nop) With(...interface{}) Interface { return n }
+func (nop) Enabled(Level) bool              { return false }
+
+// New 将 charmbracelet/log 的 Logger 适配为 Interface
+func New(l *log.Logger) Interface {
+	return charm{l}
+}
+
+type charm struct {
+	l *log.Logger
+}
+
+var charmLevels = map[Level]log.Level{
+	DebugLevel: log.DebugLevel,
+	InfoLevel:  log.InfoLevel,
+	WarnLevel:  log.WarnLevel,
+	ErrorLevel: log.ErrorLevel,
+}
+
+func (c charm) Debug(msg string, keyvals ...interface{}) {
+	c.l.Helper()
+	c.l.Debug(msg, keyvals...)
+}
+
+func (c charm) Info(msg string, keyvals ...interface{}) {
+	c.l.Helper()
+	c.l.Info(msg, keyvals...)
+}
+
+func (c charm) Warn(msg string, keyvals ...interface{}) {
+	c.l.Helper()
+	c.l.Warn(msg, keyvals...)
+}
+
+func (c charm) Error(msg string, keyvals ...interface{}) {
+	c.l.Helper()
+	c.l.Error(msg, keyvals...)
+}
+
+func (c charm) With(keyvals ...interface{}) Interface {
+	return charm{c.l.With(keyvals...)}
+}
+
+func (c charm) Enabled(level Level) bool {
+	return c.l.GetLevel() <= charmLevels[level]
+}
@@ -1,13 +1,16 @@
 package logger
 
 import (
+	"io"
 	"os"
 	"time"
 
 	"github.com/charmbracelet/log"
 )
 
-var Logger *log.Logger
+// Logger 是应用层（conf、db、服务注册）使用的全局日志，默认丢弃所有输出，Init 之后才会打印
+// groupcache 的 Group 与 Server 不使用这个全局变量，而是通过 Interface 注入各自的日志
+var Logger = log.New(io.Discard)
 
 func Init() {
 	Logger = log.NewWithOptions(os.Stderr, log.Options{
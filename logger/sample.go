@@ -0,0 +1,81 @@
+package logger
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Sample 返回按消息限流的 Interface：每个 period 内，同一条消息只输出前 first 次，之后每 thereafter 次输出一次
+// thereafter 为 0 时丢弃之后的所有同名消息；Error 级别的日志不限流
+// 适用于热路径上的日志，避免高 QPS 时日志量随请求数线性增长
+func Sample(l Interface, period time.Duration, first, thereafter int64) Interface {
+	return &sampler{
+		Interface:  l,
+		period:     int64(period),
+		first:      first,
+		thereafter: thereafter,
+		counters:   &sync.Map{},
+	}
+}
+
+type sampler struct {
+	Interface
+	period, first, thereafter int64
+	counters                  *sync.Map // msg -> *counter，With 派生的 sampler 共享计数
+}
+
+// counter 记录一个 period 内某条消息出现的次数
+type counter struct {
+	resetAt int64
+	n       int64
+}
+
+// allow 判断这条消息在当前 period 内是否应该输出
+func (s *sampler) allow(msg string) bool {
+	now := time.Now().UnixNano()
+	v, ok := s.counters.Load(msg)
+	if !ok {
+		v, _ = s.counters.LoadOrStore(msg, &counter{resetAt: now + s.period})
+	}
+	c := v.(*counter)
+	if resetAt := atomic.LoadInt64(&c.resetAt); now >= resetAt {
+		// 只有一个 goroutine 能重置计数，其余的继续按旧的计数判断
+		if atomic.CompareAndSwapInt64(&c.resetAt, resetAt, now+s.period) {
+			atomic.StoreInt64(&c.n, 0)
+		}
+	}
+	n := atomic.AddInt64(&c.n, 1)
+	if n <= s.first {
+		return true
+	}
+	return s.thereafter > 0 && (n-s.first)%s.thereafter == 0
+}
+
+func (s *sampler) Debug(msg string, keyvals ...interface{}) {
+	if s.Interface.Enabled(DebugLevel) && s.allow(msg) {
+		s.Interface.Debug(msg, keyvals...)
+	}
+}
+
+func (s *sampler) Info(msg string, keyvals ...interface{}) {
+	if s.Interface.Enabled(InfoLevel) && s.allow(msg) {
+		s.Interface.Info(msg, keyvals...)
+	}
+}
+
+func (s *sampler) Warn(msg string, keyvals ...interface{}) {
+	if s.Interface.Enabled(WarnLevel) && s.allow(msg) {
+		s.Interface.Warn(msg, keyvals...)
+	}
+}
+
+func (s *sampler) With(keyvals ...interface{}) Interface {
+	return &sampler{
+		Interface:  s.Interface.With(keyvals...),
+		period:     s.period,
+		first:      s.first,
+		thereafter: s.thereafter,
+		counters:   s.counters,
+	}
+}
@@ -0,0 +1,58 @@
+package logger
+
+import (
+	"testing"
+	"time"
+)
+
+// recorder 记录每条消息被输出的次数
+type recorder struct {
+	nop
+	counts map[string]int
+}
+
+func (r *recorder) Debug(msg string, _ ...interface{}) { r.counts[msg]++ }
+func (r *recorder) Warn(msg string, _ ...interface{})  { r.counts[msg]++ }
+func (r *recorder) Error(msg string, _ ...interface{}) { r.counts[msg]++ }
+func (r *recorder) With(...interface{}) Interface      { return r }
+func (r *recorder) Enabled(Level) bool                 { return true }
+
+func TestSample(t *testing.T) {
+	r := &recorder{counts: make(map[string]int)}
+	l := Sample(r, time.Hour, 3, 10)
+	for i := 0; i < 103; i++ {
+		l.Debug("hit")
+		l.With("k", "v").Warn("miss")
+		l.Error("fail")
+	}
+	// 前 3 次全部输出，之后的 100 次每 10 次输出一次
+	if r.counts["hit"] != 13 {
+		t.Fatalf("hit logged %d times, want 13", r.counts["hit"])
+	}
+	// With 派生的日志与原日志共享计数
+	if r.counts["miss"] != 13 {
+		t.Fatalf("miss logged %d times, want 13", r.counts["miss"])
+	}
+	if r.counts["fail"] != 103 {
+		t.Fatalf("error should not be sampled, logged %d times", r.counts["fail"])
+	}
+}
+
+func TestSampleReset(t *testing.T) {
+	r := &recorder{counts: make(map[string]int)}
+	l := Sample(r, 10*time.Millisecond, 1, 0)
+	l.Debug("hit")
+	l.Debug("hit")
+	time.Sleep(20 * time.Millisecond)
+	l.Debug("hit")
+	if r.counts["hit"] != 2 {
+		t.Fatalf("hit logged %d times, want 2", r.counts["hit"])
+	}
+}
+
+func TestNopDisabled(t *testing.T) {
+	l := Nop().With("group", "g")
+	if l.Enabled(ErrorLevel) {
+		t.Fatal("nop logger should be disabled at all levels")
+	}
+}
@@ -2,23 +2,47 @@ package lru
 
 import (
 	"container/list"
+	"time"
+)
+
+// EvictReason 表示条目被移出缓存的原因
+type EvictReason int
 
-	"github.com/1055373165/groupcache/logger"
+const (
+	// Evicted 缓存容量不足，最久未使用的条目被淘汰
+	Evicted EvictReason = iota + 1
+	// Expired 条目已过期，在 Get 时惰性删除或被 RemoveExpired 清理
+	Expired
+	// Removed 条目被 Remove 主动删除
+	Removed
 )
 
+func (r EvictReason) String() string {
+	switch r {
+	case Evicted:
+		return "evicted"
+	case Expired:
+		return "expired"
+	case Removed:
+		return "removed"
+	default:
+		return "unknown"
+	}
+}
+
 type LRUCache struct {
 	maxCacheSize int64
 	nBytes       int64
 	root         *list.List
 	m            map[string]*list.Element
-	onEcvited    func(string, Value)
+	onEcvited    func(string, Value, EvictReason)
 }
 
 type Value interface {
 	Len() int
 }
 
-func NewLRUCache(capacity int64, onEvicted func(string, Value)) *LRUCache {
+func NewLRUCache(capacity int64, onEvicted func(string, Value, EvictReason)) *LRUCache {
 	return &LRUCache{
 		maxCacheSize: capacity,
 		root:         list.New(),
@@ -28,8 +52,9 @@ func NewLRUCache(capacity int64, onEvicted func(string, Value)) *LRUCache {
 }
 
 type Entry struct {
-	Key string
-	Val Value
+	Key    string
+	Val    Value
+	Expire time.Time // 过期时间，零值表示永不过期
 }
 
 func NewEntry(key string, val Value) *Entry {
@@ -39,27 +64,42 @@ func NewEntry(key string, val Value) *Entry {
 	}
 }
 
+// expired 判断条目在 now 时刻是否已经过期
+func (e *Entry) expired(now time.Time) bool {
+	return !e.Expire.IsZero() && !now.Before(e.Expire)
+}
+
 func (l *LRUCache) Get(key string) (Value, bool) {
-	logger.Logger.Info("lru.Get()")
 	if e, ok := l.m[key]; ok {
-		l.root.MoveToFront(e)
 		kv := e.Value.(*Entry)
-		logger.Logger.Info("lru.Get 断言")
+		// 惰性过期：访问到已过期的条目时直接删除
+		if kv.expired(time.Now()) {
+			l.removeElement(e, Expired)
+			return nil, false
+		}
+		l.root.MoveToFront(e)
 		return kv.Val, true
 	} else {
 		return nil, false
 	}
 }
 
+// Put 写入一个永不过期的条目
 func (l *LRUCache) Put(key string, value Value) {
-	logger.Logger.Info("lru.Put(key, val)")
+	l.PutWithExpire(key, value, time.Time{})
+}
+
+// PutWithExpire 写入一个在 expire 时刻过期的条目，expire 为零值表示永不过期
+func (l *LRUCache) PutWithExpire(key string, value Value, expire time.Time) {
 	if e, ok := l.m[key]; ok {
 		l.root.MoveToFront(e)
-		logger.Logger.Info("lru.*Entry断言")
-		l.nBytes += int64(value.Len()) - int64(e.Value.(*Entry).Val.Len())
-		e.Value = value
+		kv := e.Value.(*Entry)
+		l.nBytes += int64(value.Len()) - int64(kv.Val.Len())
+		kv.Val = value
+		kv.Expire = expire
 	} else {
 		newEntry := NewEntry(key, value)
+		newEntry.Expire = expire
 		ele := l.root.PushFront(newEntry)
 		l.nBytes += int64(value.Len()) + int64(len(key))
 		l.m[key] = ele
@@ -71,19 +111,68 @@ func (l *LRUCache) Put(key string, value Value) {
 }
 
 func (l *LRUCache) RemoveOldest() {
-	logger.Logger.Info("lru.RemoveOldest(key, val)")
 	for l.maxCacheSize < l.nBytes {
-		kvInterface := l.root.Remove(l.root.Back())
-		logger.Logger.Info("lru.removeOldest()")
-		kv := kvInterface.(*Entry)
-		l.nBytes -= int64(kv.Val.Len()) + int64(len(kv.Key))
-		delete(l.m, kv.Key)
-		if l.onEcvited != nil {
-			l.onEcvited(kv.Key, kv.Val)
+		l.removeElement(l.root.Back(), Evicted)
+	}
+}
+
+// Evict 淘汰最久未使用的条目，缓存为空时返回 false
+func (l *LRUCache) Evict() bool {
+	e := l.root.Back()
+	if e == nil {
+		return false
+	}
+	l.removeElement(e, Evicted)
+	return true
+}
+
+// Remove 删除 key 对应的条目，key 不存在时返回 false
+func (l *LRUCache) Remove(key string) bool {
+	if e, ok := l.m[key]; ok {
+		l.removeElement(e, Removed)
+		return true
+	}
+	return false
+}
+
+// RemoveExpired 清理所有已过期的条目，返回清理的条目数
+func (l *LRUCache) RemoveExpired() int {
+	now := time.Now()
+	n := 0
+	for e := l.root.Back(); e != nil; {
+		prev := e.Prev()
+		if e.Value.(*Entry).expired(now) {
+			l.removeElement(e, Expired)
+			n++
 		}
+		e = prev
 	}
+	return n
+}
+
+func (l *LRUCache) removeElement(e *list.Element, reason EvictReason) {
+	kv := l.root.Remove(e).(*Entry)
+	l.nBytes -= int64(kv.Val.Len()) + int64(len(kv.Key))
+	delete(l.m, kv.Key)
+	if l.onEcvited != nil {
+		l.onEcvited(kv.Key, kv.Val, reason)
+	}
+}
+
+// Keys 返回当前所有的 key，顺序不做保证
+func (l *LRUCache) Keys() []string {
+	keys := make([]string, 0, len(l.m))
+	for key := range l.m {
+		keys = append(keys, key)
+	}
+	return keys
 }
 
 func (l *LRUCache) Len() int {
 	return l.root.Len()
 }
+
+// Bytes 返回当前缓存占用的字节数（key 与 value 长度之和）
+func (l *LRUCache) Bytes() int64 {
+	return l.nBytes
+}
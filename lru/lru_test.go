@@ -3,6 +3,7 @@ package lru
 import (
 	"log"
 	"testing"
+	"time"
 )
 
 type MyType string
@@ -45,3 +46,44 @@ func TestLru(t *testing.T) {
 		t.Fatal("key should be die out")
 	}
 }
+
+func TestLruUpdate(t *testing.T) {
+	lru := NewLRUCache(0, nil)
+	lru.Put("k", MyType("123"))
+	lru.Put("k", MyType("12345"))
+	if v, ok := lru.Get("k"); !ok || v != MyType("12345") {
+		t.Fatalf("expect updated value 12345, but got %v", v)
+	}
+	if expect := int64(len("k") + len("12345")); lru.Bytes() != expect {
+		t.Fatalf("expect lru bytes is %d but got %d", expect, lru.Bytes())
+	}
+}
+
+func TestLruExpire(t *testing.T) {
+	var reasons []EvictReason
+	lru := NewLRUCache(0, func(key string, value Value, reason EvictReason) {
+		reasons = append(reasons, reason)
+	})
+	lru.PutWithExpire("past", MyType("1"), time.Now().Add(-time.Second))
+	lru.PutWithExpire("future", MyType("2"), time.Now().Add(time.Hour))
+	lru.Put("forever", MyType("3"))
+
+	// 惰性过期
+	if _, ok := lru.Get("past"); ok {
+		t.Fatal("expired key should not be returned")
+	}
+	if _, ok := lru.Get("future"); !ok {
+		t.Fatal("key not yet expired should be returned")
+	}
+
+	lru.PutWithExpire("past2", MyType("4"), time.Now().Add(-time.Second))
+	if n := lru.RemoveExpired(); n != 1 {
+		t.Fatalf("expect 1 expired key removed, but got %d", n)
+	}
+	if lru.Len() != 2 {
+		t.Fatalf("expect lru length is 2 but got %d", lru.Len())
+	}
+	if len(reasons) != 2 || reasons[0] != Expired || reasons[1] != Expired {
+		t.Fatalf("expect 2 expired callbacks, but got %v", reasons)
+	}
+}
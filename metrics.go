@@ -0,0 +1,140 @@
+package etcd
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc/status"
+)
+
+// metrics 模块将 Group 的统计信息以 Prometheus 格式暴露出来
+// Group 与 cache 的计数在每次采集时读取，请求路径上只有原子加法，不依赖 Prometheus
+const metricsNamespace = "groupcache"
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	// peerRPCDuration 是本节点发往各个 peer 的 RPC 耗时
+	peerRPCDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "peer_rpc_duration_seconds",
+		Help:      "Latency of RPCs sent to peers.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 15),
+	}, []string{"peer", "method", "code"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		newGroupCollector(),
+		peerRPCDuration,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// MetricsHandler 返回暴露所有 groupcache 指标的 HTTP handler
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// MetricsCollectors 返回 groupcache 的指标收集器，用于注册到应用自己的 Registry 中
+func MetricsCollectors() []prometheus.Collector {
+	return []prometheus.Collector{newGroupCollector(), peerRPCDuration}
+}
+
+// observeRPC 记录一次发往 peer 的 RPC 的耗时，err 是 gRPC 返回的原始错误
+func observeRPC(peer, method string, start time.Time, err error) {
+	peerRPCDuration.WithLabelValues(peer, method, status.Code(err).String()).Observe(time.Since(start).Seconds())
+}
+
+// groupCounter 描述了从 Stats 中读取的一个计数器
+type groupCounter struct {
+	desc  *prometheus.Desc
+	value func(*Stats) int64
+}
+
+// cacheMetric 描述了从 CacheStats 中读取的一个指标
+type cacheMetric struct {
+	desc      *prometheus.Desc
+	valueType prometheus.ValueType
+	value     func(CacheStats) int64
+}
+
+// groupCollector 在采集时遍历所有 Group，读取 Stats 与 mainCache/hotCache 的统计信息
+type groupCollector struct {
+	counters []groupCounter
+	dedupes  *prometheus.Desc
+	caches   []cacheMetric
+}
+
+func newGroupCollector() *groupCollector {
+	groupLabels := []string{"group"}
+	cacheLabels := []string{"group", "cache"}
+	counter := func(name, help string, value func(*Stats) int64) groupCounter {
+		return groupCounter{prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", name), help, groupLabels, nil), value}
+	}
+	cacheDesc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "cache", name), help, cacheLabels, nil)
+	}
+
+	return &groupCollector{
+		counters: []groupCounter{
+			counter("gets_total", "Number of Get requests.", func(s *Stats) int64 { return s.Gets.Load() }),
+			counter("main_cache_hits_total", "Number of main cache hits.", func(s *Stats) int64 { return s.MainHits.Load() }),
+			counter("hot_cache_hits_total", "Number of hot cache hits.", func(s *Stats) int64 { return s.HotHits.Load() }),
+			counter("stale_hits_total", "Number of stale values served.", func(s *Stats) int64 { return s.StaleHits.Load() }),
+			counter("peer_loads_total", "Number of values loaded from peers.", func(s *Stats) int64 { return s.PeerLoads.Load() }),
+			counter("peer_errors_total", "Number of failed peer requests.", func(s *Stats) int64 { return s.PeerErrors.Load() }),
+			counter("retriever_loads_total", "Number of values loaded from the retriever.", func(s *Stats) int64 { return s.RetrieverLoads.Load() }),
+			counter("retriever_errors_total", "Number of retriever failures.", func(s *Stats) int64 { return s.RetrieverErrors.Load() }),
+			counter("server_requests_total", "Number of requests received from peers.", func(s *Stats) int64 { return s.ServerRequests.Load() }),
+		},
+		dedupes: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "singleflight_dedupes_total"),
+			"Number of loads deduplicated by singleflight.", groupLabels, nil),
+		caches: []cacheMetric{
+			{cacheDesc("bytes", "Bytes in the cache."), prometheus.GaugeValue, func(s CacheStats) int64 { return s.Bytes }},
+			{cacheDesc("items", "Items in the cache."), prometheus.GaugeValue, func(s CacheStats) int64 { return s.Items }},
+			{cacheDesc("gets_total", "Cache lookups."), prometheus.CounterValue, func(s CacheStats) int64 { return s.Gets }},
+			{cacheDesc("hits_total", "Cache hits."), prometheus.CounterValue, func(s CacheStats) int64 { return s.Hits }},
+			{cacheDesc("evictions_total", "Entries evicted for capacity."), prometheus.CounterValue, func(s CacheStats) int64 { return s.Evictions }},
+			{cacheDesc("expires_total", "Entries removed after expiry."), prometheus.CounterValue, func(s CacheStats) int64 { return s.Expires }},
+		},
+	}
+}
+
+func (c *groupCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, counter := range c.counters {
+		ch <- counter.desc
+	}
+	ch <- c.dedupes
+	for _, m := range c.caches {
+		ch <- m.desc
+	}
+}
+
+func (c *groupCollector) Collect(ch chan<- prometheus.Metric) {
+	mu.RLock()
+	all := make([]*Group, 0, len(groups))
+	for _, g := range groups {
+		all = append(all, g)
+	}
+	mu.RUnlock()
+
+	for _, g := range all {
+		for _, counter := range c.counters {
+			ch <- prometheus.MustNewConstMetric(counter.desc, prometheus.CounterValue, float64(counter.value(&g.Stats)), g.name)
+		}
+		ch <- prometheus.MustNewConstMetric(c.dedupes, prometheus.CounterValue, float64(g.flight.Dups()), g.name)
+		for _, which := range []struct {
+			name  string
+			stats CacheStats
+		}{{"main", g.CacheStats(MainCache)}, {"hot", g.CacheStats(HotCache)}} {
+			for _, m := range c.caches {
+				ch <- prometheus.MustNewConstMetric(m.desc, m.valueType, float64(m.value(which.stats)), g.name, which.name)
+			}
+		}
+	}
+}
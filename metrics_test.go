@@ -0,0 +1,46 @@
+package etcd
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	g := NewGroup("metrics", 2<<10, RetrieveFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}))
+	defer DestroryGroup("metrics")
+
+	ctx := context.Background()
+	g.Get(ctx, "Tom")
+	g.Get(ctx, "Tom")
+
+	s, err := NewServer("localhost:9999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, s)
+	c.name = "metrics-peer"
+	if _, err := c.Fetch(ctx, "metrics", "Jack"); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	for _, want := range []string{
+		`groupcache_gets_total{group="metrics"} 3`,
+		`groupcache_main_cache_hits_total{group="metrics"} 1`,
+		`groupcache_retriever_loads_total{group="metrics"} 2`,
+		`groupcache_server_requests_total{group="metrics"} 1`,
+		`groupcache_cache_items{cache="main",group="metrics"} 2`,
+		`groupcache_peer_rpc_duration_seconds_count{code="OK",method="GetStream",peer="metrics-peer"}`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("expect metrics to contain %s", want)
+		}
+	}
+}
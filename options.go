@@ -0,0 +1,202 @@
+package etcd
+
+import (
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/1055373165/groupcache/consistenthash"
+	"github.com/1055373165/groupcache/eviction"
+	"github.com/1055373165/groupcache/logger"
+)
+
+// options 模块为 NewGroup、NewServer 和 Group.Set 提供可选配置，未指定的配置使用默认值
+
+// GroupOption 是 NewGroup 的可选配置
+type GroupOption interface {
+	applyGroup(*Group)
+}
+
+// ServerOption 是 NewServer 的可选配置
+type ServerOption interface {
+	applyServer(*Server)
+}
+
+// Option 是同时适用于 NewGroup 和 NewServer 的配置
+type Option interface {
+	GroupOption
+	ServerOption
+}
+
+type groupOptionFunc func(*Group)
+
+func (f groupOptionFunc) applyGroup(g *Group) { f(g) }
+
+type serverOptionFunc func(*Server)
+
+func (f serverOptionFunc) applyServer(s *Server) { f(s) }
+
+// SetOption 是 Group.Set 的可选配置
+type SetOption interface {
+	applySet(*setOptions)
+}
+
+type setOptions struct {
+	hotCache bool
+}
+
+type setOptionFunc func(*setOptions)
+
+func (f setOptionFunc) applySet(o *setOptions) { f(o) }
+
+// WithHotCache 在 key 的 owner 是远端节点时，同时在本节点的 hotCache 中保留一份写入的值
+// 默认只删除本节点 hotCache 中的旧副本，之后的读取从 owner 取回
+func WithHotCache() SetOption {
+	return setOptionFunc(func(o *setOptions) {
+		o.hotCache = true
+	})
+}
+
+// WithLogger 设置 Group 或 Server 使用的日志，默认不输出任何日志
+func WithLogger(l logger.Interface) Option {
+	return loggerOption{l}
+}
+
+type loggerOption struct {
+	l logger.Interface
+}
+
+func (o loggerOption) applyGroup(g *Group)   { g.SetLogger(o.l) }
+func (o loggerOption) applyServer(s *Server) { s.SetLogger(o.l) }
+
+// WithEvictionPolicy 设置 mainCache 和 hotCache 的淘汰策略，默认为 eviction.LRU
+// 例如存在批量扫描冷数据的场景时，可以使用 eviction.TinyLFU 或 eviction.ARC 避免热点数据被挤出
+func WithEvictionPolicy(policy eviction.Factory) GroupOption {
+	return groupOptionFunc(func(g *Group) {
+		g.policy = policy
+	})
+}
+
+// WithHotCacheBytes 设置 hotCache 的容量，默认为 mainCache 的 1/8，0 表示不限制容量
+func WithHotCacheBytes(n int64) GroupOption {
+	return groupOptionFunc(func(g *Group) {
+		g.hotCacheBytes = n
+	})
+}
+
+// WithCacheShards 设置 mainCache 和 hotCache 的分片数量，默认为 16
+// 内置的淘汰策略在所有分片之间共享容量；自定义的策略没有实现 eviction.Evicter 时，每个分片的容量是总容量的 1/n
+func WithCacheShards(n int) GroupOption {
+	return groupOptionFunc(func(g *Group) {
+		g.cacheShards = n
+	})
+}
+
+// WithJanitorInterval 设置后台清理过期条目的间隔，默认为 1 分钟，不大于 0 时不启动后台清理，过期条目只在访问时惰性删除
+func WithJanitorInterval(d time.Duration) GroupOption {
+	return groupOptionFunc(func(g *Group) {
+		g.janitorInterval = d
+	})
+}
+
+// WithNotFoundTTL 设置数据源中不存在的 key 的缓存时长，默认为 10 秒，0 表示不缓存
+func WithNotFoundTTL(ttl time.Duration) GroupOption {
+	return groupOptionFunc(func(g *Group) {
+		g.notFoundTTL = ttl
+	})
+}
+
+// WithFailurePolicy 设置 owner 请求失败时的处理策略，默认为 FallbackLocal
+func WithFailurePolicy(policy FailurePolicy) GroupOption {
+	return groupOptionFunc(func(g *Group) {
+		g.failurePolicy = policy
+	})
+}
+
+// WithStaleWhileRevalidate 启用 stale-while-revalidate
+// Retriever 没有指定过期时间的数据在 soft 之后过期，Retriever 指定了过期时间的数据以该时间作为 soft 过期时间；
+// 过期之后的 hard-soft 时间内，Get 立即返回旧值并在后台刷新，不阻塞在数据源上
+func WithStaleWhileRevalidate(soft, hard time.Duration) GroupOption {
+	return groupOptionFunc(func(g *Group) {
+		g.softTTL, g.hardTTL = soft, hard
+	})
+}
+
+// WithReplicas 设置一致性哈希环上每个真实节点的虚拟节点数，默认为 50
+// 与 WithHash 一样只作用于默认的一致性哈希环，指定了 WithPlacement 时不生效
+func WithReplicas(n int) ServerOption {
+	return serverOptionFunc(func(s *Server) {
+		s.replicas = n
+	})
+}
+
+// WithHash 设置一致性哈希环使用的哈希函数，默认为 crc32.ChecksumIEEE
+func WithHash(hash consistenthash.Hash) ServerOption {
+	return serverOptionFunc(func(s *Server) {
+		s.hash = hash
+	})
+}
+
+// WithPlacement 设置 key 的放置算法，默认为一致性哈希环
+func WithPlacement(p consistenthash.Placement) ServerOption {
+	return serverOptionFunc(func(s *Server) {
+		s.Placement = p
+	})
+}
+
+// WithEtcdConfig 设置服务注册、节点发现和缓存失效广播使用的 etcd 配置，默认连接 localhost:2379
+func WithEtcdConfig(cfg clientv3.Config) ServerOption {
+	return serverOptionFunc(func(s *Server) {
+		s.etcdConfig = cfg
+	})
+}
+
+// WithLeaseTTL 设置服务注册的租约时长，默认为 5 秒，按秒向上取整
+// 节点异常退出后，其他节点最多在一个租约时长之后将它移出哈希环
+func WithLeaseTTL(ttl time.Duration) ServerOption {
+	return serverOptionFunc(func(s *Server) {
+		s.leaseTTL = ttl
+	})
+}
+
+// WithFetchTimeout 设置调用方的 ctx 没有截止时间时，请求远端节点的超时时间，默认为 10 秒
+func WithFetchTimeout(d time.Duration) ServerOption {
+	return serverOptionFunc(func(s *Server) {
+		s.fetchTimeout = d
+	})
+}
+
+// WithRegistry 设置本节点注册到服务发现系统的方式，默认以租约的形式注册到 WithEtcdConfig 指定的 etcd
+func WithRegistry(r Registry) ServerOption {
+	return serverOptionFunc(func(s *Server) {
+		s.registry = r
+	})
+}
+
+// WithWeight 设置节点容量权重，默认为 1
+func WithWeight(weight int) ServerOption {
+	return serverOptionFunc(func(s *Server) {
+		s.Weight = weight
+	})
+}
+
+// WithLoadFactor 启用有界负载，参见 Server.LoadFactor
+func WithLoadFactor(f float64) ServerOption {
+	return serverOptionFunc(func(s *Server) {
+		s.LoadFactor = f
+	})
+}
+
+// WithMaxValueBytes 设置单个 value 的大小上限，默认为 64MB
+func WithMaxValueBytes(n int64) ServerOption {
+	return serverOptionFunc(func(s *Server) {
+		s.MaxValueBytes = n
+	})
+}
+
+// WithMetricsAddr 设置暴露 Prometheus 指标的 HTTP 地址，默认不启动
+func WithMetricsAddr(addr string) ServerOption {
+	return serverOptionFunc(func(s *Server) {
+		s.MetricsAddr = addr
+	})
+}
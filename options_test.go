@@ -0,0 +1,76 @@
+package etcd
+
+import (
+	"testing"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/1055373165/groupcache/consistenthash"
+	"github.com/1055373165/groupcache/logger"
+)
+
+func TestGroupOptions(t *testing.T) {
+	g := NewGroup("options", 2<<10, RetrieveFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}),
+		WithHotCacheBytes(1<<10),
+		WithCacheShards(4),
+		WithJanitorInterval(0),
+		WithNotFoundTTL(time.Minute),
+		WithFailurePolicy(ServeStale),
+		WithStaleWhileRevalidate(time.Second, time.Minute),
+		WithLogger(logger.Nop()),
+	)
+	defer DestroryGroup("options")
+
+	if g.mainCache.maxCacheSize != 2<<10 || g.hotCache.maxCacheSize != 1<<10 {
+		t.Fatalf("unexpected cache size, main %d hot %d", g.mainCache.maxCacheSize, g.hotCache.maxCacheSize)
+	}
+	if len(g.mainCache.shards) != 4 || len(g.hotCache.shards) != 4 {
+		t.Fatalf("expect 4 shards, but got %d and %d", len(g.mainCache.shards), len(g.hotCache.shards))
+	}
+	if g.mainCache.stopJanitor != nil {
+		t.Fatal("janitor should not be started")
+	}
+	if g.notFoundTTL != time.Minute || g.failurePolicy != ServeStale || !g.revalidating() {
+		t.Fatalf("unexpected group settings: %v %v %v %v", g.notFoundTTL, g.failurePolicy, g.softTTL, g.hardTTL)
+	}
+}
+
+func TestServerOptions(t *testing.T) {
+	hashed := 0
+	s, err := NewServer("localhost:9999",
+		WithReplicas(3),
+		WithHash(func(data []byte) uint32 {
+			hashed++
+			return uint32(len(data))
+		}),
+		WithEtcdConfig(clientv3.Config{Endpoints: []string{"etcd:2379"}}),
+		WithLeaseTTL(30*time.Second),
+		WithFetchTimeout(time.Second),
+		WithWeight(2),
+		WithMaxValueBytes(1<<20),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Placement.AddTruthNode("localhost:9999")
+	if hashed != 3 {
+		t.Fatalf("expect 3 virtual nodes hashed by the custom hash, but got %d", hashed)
+	}
+	if s.etcdConfig.Endpoints[0] != "etcd:2379" || s.leaseTTL != 30*time.Second || s.fetchTimeout != time.Second {
+		t.Fatalf("unexpected server settings: %v %v %v", s.etcdConfig.Endpoints, s.leaseTTL, s.fetchTimeout)
+	}
+	if s.Weight != 2 || s.MaxValueBytes != 1<<20 {
+		t.Fatalf("unexpected weight %d or max value bytes %d", s.Weight, s.MaxValueBytes)
+	}
+
+	s, err = NewServer("localhost:9999", WithReplicas(3), WithPlacement(consistenthash.NewJumpHash()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Placement.(*consistenthash.JumpHash); !ok {
+		t.Fatalf("expect jump hash placement, but got %T", s.Placement)
+	}
+}
@@ -1,11 +1,26 @@
 package etcd
 
+import "context"
+
 // Picker 定义了获取分布式节点的能力
 type Picker interface {
-	Pick(key string) (Fetcher, bool)
+	Pick(ctx context.Context, key string) (Fetcher, bool)
+	// PickNext 返回排除 failed 之后 key 的 owner，用于 owner 请求失败后的重试
+	// 返回 false 表示应由本节点负责，或者无法确定下一个节点
+	PickNext(ctx context.Context, key string, failed Fetcher) (Fetcher, bool)
+	// GetAll 返回除自身以外的所有节点，用于广播删除等操作
+	GetAll() []Fetcher
 }
 
 // Fetcher 定义了从远端获取缓存的能力，所以每个 Peer 都应实现这个接口
+// ctx 的截止时间会随 gRPC 请求一起传递到远端节点，返回的 ByteView 携带了 owner 上数据的过期时间
 type Fetcher interface {
-	Fetch(group string, key string) ([]byte, error)
+	Fetch(ctx context.Context, group string, key string) (ByteView, error)
+	// FetchMany 一次从远端节点获取多个 key，返回每个 key 各自的结果
+	// 返回的 error 只表示整个请求失败（例如网络错误），单个 key 的错误记录在 Result.Err 中
+	FetchMany(ctx context.Context, group string, keys []string) (map[string]Result, error)
+	// Remove 删除远端节点本地缓存中的 key
+	Remove(ctx context.Context, group string, key string) error
+	// Set 将值写入远端节点的 mainCache
+	Set(ctx context.Context, group string, key string, value ByteView) error
 }
@@ -0,0 +1,56 @@
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/1055373165/groupcache/logger"
+	serverregistrydiscover "github.com/1055373165/groupcache/server_registry_discover"
+)
+
+// Registry 负责将本节点发布到服务发现系统，其他节点据此把本节点加入哈希环
+// Start 在开始监听之后调用 Register；Shutdown 最先调用 Deregister，使其他节点在本节点停止服务之前不再把请求路由过来
+type Registry interface {
+	Register(ctx context.Context, addr string, weight int) error
+	Deregister(ctx context.Context, addr string) error
+}
+
+// etcdRegistry 是默认的 Registry，以租约的形式将节点注册到 etcd 的 groupcache 服务下
+type etcdRegistry struct {
+	cfg      clientv3.Config
+	leaseTTL time.Duration
+	log      logger.Interface // 与 Server 使用同一个日志，由 Server.SetLogger 更新
+
+	mu  sync.Mutex
+	reg *serverregistrydiscover.Registration
+}
+
+func (r *etcdRegistry) Register(ctx context.Context, addr string, weight int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.reg != nil {
+		return fmt.Errorf("%s is already registered", addr)
+	}
+	md := serverregistrydiscover.Metadata{Weight: weight}
+	reg, err := serverregistrydiscover.NewRegistration(ctx, r.cfg, r.leaseTTL, "groupcache", addr, md, r.log)
+	if err != nil {
+		return err
+	}
+	r.reg = reg
+	return nil
+}
+
+func (r *etcdRegistry) Deregister(ctx context.Context, addr string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.reg == nil {
+		return nil
+	}
+	err := r.reg.Close(ctx)
+	r.reg = nil
+	return err
+}
@@ -2,14 +2,18 @@ package etcd
 
 import (
 	"context"
-
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/naming/endpoints"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
 
 	"github.com/1055373165/groupcache/consistenthash"
@@ -25,6 +29,14 @@ import (
 const (
 	defaultAddr     = "127.0.0.1:6324"
 	defaultReplicas = 50
+	// 单个 value 的默认大小上限
+	defaultMaxValueBytes = 64 << 20
+	// GetStream 每段数据的大小，远小于 gRPC 默认 4MB 的消息大小限制
+	streamChunkSize = 256 << 10
+	// GetMany 单次响应中 value 的总大小上限，同样远小于 4MB，超出的 value 由调用方通过 GetStream 获取
+	getManyBatchBytes = 2 << 20
+	// Stop 等待进行中的请求处理完成的最长时间
+	defaultShutdownTimeout = 10 * time.Second
 )
 
 var (
@@ -32,22 +44,51 @@ var (
 		Endpoints:   []string{"localhost:2379"},
 		DialTimeout: 5 * time.Second,
 	}
+	// 节点 watch 异常结束后重新监听的等待时间，从 minRewatchBackoff 开始逐次翻倍，最长为 maxRewatchBackoff
+	minRewatchBackoff = 500 * time.Millisecond
+	maxRewatchBackoff = 30 * time.Second
 )
 
 // server 和 Group 是解耦合的，所以 server 要自己实现并发控制
 type Server struct {
 	pb.UnimplementedGroupCacheServer
 
-	Addr        string     // format: ip:port
-	Status      bool       // true: running false: stop
-	stopsSignal chan error // 通知 registery revoke 服务
-	mu          sync.Mutex
-	consHash    *consistenthash.ConsistentHash
-	clients     map[string]*client
+	Addr       string  // format: ip:port
+	Status     bool    // true: running false: stop
+	Weight     int     // 节点容量权重，随注册信息发布到 etcd，其他节点按权重分配虚拟节点
+	LoadFactor float64 // 大于 1 且 Placement 支持时启用有界负载，Pick 跳过负载超过平均值 LoadFactor 倍的节点
+	// MaxValueBytes 是本节点对外提供和接收的单个 value 的大小上限，需要在 Start 之前设置
+	MaxValueBytes int64
+	// MetricsAddr 非空时，Start 会在这个地址上启动 HTTP 服务，通过 /metrics 暴露 Prometheus 指标
+	MetricsAddr string
+	// Placement 决定 key 由哪个节点负责，默认为一致性哈希环，需要在 Start/SetPeers 之前设置
+	// 实现自身保证并发安全，Pick 读取时无需加锁
+	Placement consistenthash.Placement
+
+	inflight   int64      // 本节点正在处理的来自其他节点的请求数
+	lifecycle  sync.Mutex // 串行化 Start 与 Shutdown，它们执行期间不持有 mu，不阻塞请求处理
+	mu         sync.RWMutex
+	grpcServer *grpc.Server
+	ready      chan struct{} // Start 完成后关闭
+	registry   Registry
+	clients    map[string]*client // 每个 peer 一条长连接，在 SetPeers 和 Shutdown 时回收
+	etcdCli    *clientv3.Client   // 所有 peer 连接共享的服务发现客户端
+	stopWatch  context.CancelFunc // 停止监听 etcd 中的节点变化
+	metricsSrv *http.Server       // 暴露 Prometheus 指标的 HTTP 服务
+	// log 携带 addr 字段，hotLog 是它的限流版本，用于每个请求都可能触发的日志
+	log, hotLog logger.Interface
+
+	// 以下配置在 NewServer 时通过 ServerOption 设置，参见 options.go
+	replicas     int                 // 默认一致性哈希环的虚拟节点数
+	hash         consistenthash.Hash // 默认一致性哈希环的哈希函数
+	etcdConfig   clientv3.Config
+	leaseTTL     time.Duration
+	fetchTimeout time.Duration
 }
 
 // NewServer 创建 cache 的 server，若 addr 为空，则使用 defaultAddr
-func NewServer(addr string) (*Server, error) {
+// 可选配置参见 options.go，例如 NewServer(addr, WithEtcdConfig(cfg), WithReplicas(100), WithLogger(l))
+func NewServer(addr string, opts ...ServerOption) (*Server, error) {
 	if addr == "" {
 		addr = defaultAddr
 	}
@@ -55,139 +96,838 @@ func NewServer(addr string) (*Server, error) {
 	if !utils.ValidPerrAddr(addr) {
 		return nil, fmt.Errorf("invalid addr %s, it should be x.x.x.x:port", addr)
 	}
-	return &Server{Addr: addr}, nil
+	s := &Server{
+		Addr:          addr,
+		Weight:        1,
+		MaxValueBytes: defaultMaxValueBytes,
+		replicas:      defaultReplicas,
+		etcdConfig:    defaultEtcdConfig,
+		leaseTTL:      serverregistrydiscover.DefaultLeaseTTL,
+		fetchTimeout:  defaultFetchTimeout,
+		ready:         make(chan struct{}),
+	}
+	s.SetLogger(logger.Nop())
+	for _, opt := range opts {
+		opt.applyServer(s)
+	}
+	if s.Placement == nil {
+		s.Placement = consistenthash.NewConsistentHash(s.replicas, s.hash)
+	}
+	if s.registry == nil {
+		s.registry = &etcdRegistry{cfg: s.etcdConfig, leaseTTL: s.leaseTTL, log: s.log}
+	}
+	return s, nil
+}
+
+// SetLogger 设置 Server 及其 peer 连接使用的日志，默认不输出任何日志，需要在 Start 之前设置
+func (s *Server) SetLogger(l logger.Interface) {
+	s.log = l.With("addr", s.Addr)
+	s.hotLog = logger.Sample(s.log, logSamplePeriod, logSampleFirst, logSampleThereafter)
+	if r, ok := s.registry.(*etcdRegistry); ok {
+		r.log = s.log
+	}
+}
+
+// logRequest 以 debug 级别记录收到的请求
+func (s *Server) logRequest(method, group, key string) {
+	if s.hotLog.Enabled(logger.DebugLevel) {
+		s.hotLog.Debug("recv request", "method", method, "group", group, "key_hash", keyHash(key))
+	}
+}
+
+// peerRequestKey 是标记 ctx 来自其他节点的 key
+type peerRequestKey struct{}
+
+// withPeer 标记 ctx 对应的请求由其他节点转发而来
+func withPeer(ctx context.Context) context.Context {
+	return context.WithValue(ctx, peerRequestKey{}, true)
+}
+
+// fromPeer 判断 ctx 对应的请求是否由其他节点转发而来，这样的请求只在本节点处理，不会再次转发
+func fromPeer(ctx context.Context) bool {
+	v, _ := ctx.Value(peerRequestKey{}).(bool)
+	return v
 }
 
 // Get 实现了 Groupcache service 的 Get 方法
 func (s *Server) Get(ctx context.Context, req *pb.GetRequest) (*pb.GetResponse, error) {
+	atomic.AddInt64(&s.inflight, 1)
+	defer atomic.AddInt64(&s.inflight, -1)
+
 	group, key := req.GetGroup(), req.GetKey()
 	resp := &pb.GetResponse{}
-	logger.Logger.Info("[groupcache server %s] Recv RPC Request - (%s)/(%s)", s.Addr, group, key)
+	s.logRequest("Get", group, key)
 
 	if key == "" || group == "" {
-		return resp, fmt.Errorf("key and group name is reqiured")
+		return resp, toStatus(ErrInvalidRequest)
 	}
 
 	g := GetGroup(group)
 	if g == nil {
-		return resp, fmt.Errorf("group %s not found", group)
+		return resp, toStatus(fmt.Errorf("%w: %s", ErrGroupNotFound, group))
+	}
+	g.Stats.ServerRequests.Add(1)
+	// ctx 携带了调用方通过 gRPC 元数据传递过来的截止时间
+	view, err := g.Get(withPeer(ctx), key)
+	if errors.Is(err, ErrNotFound) {
+		resp.NotFound = true
+		return resp, nil
 	}
-	view, err := g.Get(key)
 	if err != nil {
-		return resp, err
+		return resp, toStatus(err)
+	}
+	if err := s.checkValueSize(group, key, view.Len()); err != nil {
+		return resp, toStatus(err)
 	}
 
 	resp.Value = view.Bytes()
+	if expire := view.Expire(); !expire.IsZero() {
+		resp.Expire = expire.UnixNano()
+	}
 	return resp, nil
 }
 
-// Start 启动 Cache 服务
-func (s *Server) Start() error {
-	s.mu.Lock()
+// GetStream 实现了 Groupcache service 的 GetStream 方法，将值按 streamChunkSize 切分后依次发送
+// 第一段携带完整值的大小和过期时间，空值也会发送一段
+func (s *Server) GetStream(req *pb.GetRequest, stream pb.GroupCache_GetStreamServer) error {
+	atomic.AddInt64(&s.inflight, 1)
+	defer atomic.AddInt64(&s.inflight, -1)
 
-	if s.Status {
-		s.mu.Unlock()
+	group, key := req.GetGroup(), req.GetKey()
+	s.logRequest("GetStream", group, key)
+
+	if key == "" || group == "" {
+		return toStatus(ErrInvalidRequest)
+	}
+
+	g := GetGroup(group)
+	if g == nil {
+		return toStatus(fmt.Errorf("%w: %s", ErrGroupNotFound, group))
+	}
+	g.Stats.ServerRequests.Add(1)
+	view, err := g.Get(withPeer(stream.Context()), key)
+	if errors.Is(err, ErrNotFound) {
+		return stream.Send(&pb.GetChunk{NotFound: true})
+	}
+	if err != nil {
+		return toStatus(err)
+	}
+	if err := s.checkValueSize(group, key, view.Len()); err != nil {
+		return toStatus(err)
+	}
+
+	// ByteView 是只读的，直接切分底层数组即可，无需拷贝
+	data := view.b
+	chunk := &pb.GetChunk{Size: int64(len(data))}
+	if expire := view.Expire(); !expire.IsZero() {
+		chunk.Expire = expire.UnixNano()
+	}
+	for first := true; first || len(data) > 0; first = false {
+		n := len(data)
+		if n > streamChunkSize {
+			n = streamChunkSize
+		}
+		chunk.Data = data[:n]
+		if err := stream.Send(chunk); err != nil {
+			return err
+		}
+		data = data[n:]
+		chunk = &pb.GetChunk{}
+	}
+	return nil
+}
+
+// checkValueSize 检查 value 是否超过 MaxValueBytes
+func (s *Server) checkValueSize(group, key string, n int) error {
+	if s.MaxValueBytes > 0 && int64(n) > s.MaxValueBytes {
+		return fmt.Errorf("%w: %s/%s is %d bytes, exceeds limit %d", ErrValueTooLarge, group, key, n, s.MaxValueBytes)
+	}
+	return nil
+}
+
+// GetMany 实现了 Groupcache service 的 GetMany 方法，单个 key 的错误记录在对应的 item 中
+// value 的总大小超过 getManyBatchBytes 后，其余的 value 不再放入响应，只标记 truncated
+func (s *Server) GetMany(ctx context.Context, req *pb.GetManyRequest) (*pb.GetManyResponse, error) {
+	atomic.AddInt64(&s.inflight, 1)
+	defer atomic.AddInt64(&s.inflight, -1)
+
+	group, keys := req.GetGroup(), req.GetKeys()
+	resp := &pb.GetManyResponse{}
+	if s.hotLog.Enabled(logger.DebugLevel) {
+		s.hotLog.Debug("recv request", "method", "GetMany", "group", group, "keys", len(keys))
+	}
+
+	if group == "" {
+		return resp, toStatus(ErrInvalidRequest)
+	}
+
+	g := GetGroup(group)
+	if g == nil {
+		return resp, toStatus(fmt.Errorf("%w: %s", ErrGroupNotFound, group))
+	}
+	g.Stats.ServerRequests.Add(1)
+
+	results := g.GetMulti(withPeer(ctx), keys)
+	resp.Items = make([]*pb.GetManyItem, 0, len(results))
+	budget := getManyBatchBytes
+	for key, result := range results {
+		item := &pb.GetManyItem{Key: key}
+		if result.Err == nil {
+			result.Err = s.checkValueSize(group, key, result.Value.Len())
+		}
+		if errors.Is(result.Err, ErrNotFound) {
+			item.NotFound = true
+		} else if result.Err != nil {
+			item.Error = statusMessage(result.Err)
+			item.Code = uint32(errorCode(result.Err))
+		} else if n := result.Value.Len(); n > budget {
+			item.Truncated = true
+		} else {
+			budget -= n
+			item.Value = result.Value.Bytes()
+			if expire := result.Value.Expire(); !expire.IsZero() {
+				item.Expire = expire.UnixNano()
+			}
+		}
+		resp.Items = append(resp.Items, item)
+	}
+	return resp, nil
+}
+
+// Delete 实现了 Groupcache service 的 Delete 方法，只删除本节点的缓存
+func (s *Server) Delete(ctx context.Context, req *pb.DeleteRequest) (*pb.DeleteResponse, error) {
+	atomic.AddInt64(&s.inflight, 1)
+	defer atomic.AddInt64(&s.inflight, -1)
+
+	group, key := req.GetGroup(), req.GetKey()
+	resp := &pb.DeleteResponse{}
+	s.logRequest("Delete", group, key)
+
+	if key == "" || group == "" {
+		return resp, toStatus(ErrInvalidRequest)
+	}
+
+	g := GetGroup(group)
+	if g == nil {
+		return resp, toStatus(fmt.Errorf("%w: %s", ErrGroupNotFound, group))
+	}
+	g.Stats.ServerRequests.Add(1)
+	g.localRemove(key)
+	return resp, nil
+}
+
+// Set 实现了 Groupcache service 的 Set 方法，将值写入本节点的 mainCache
+func (s *Server) Set(ctx context.Context, req *pb.SetRequest) (*pb.SetResponse, error) {
+	atomic.AddInt64(&s.inflight, 1)
+	defer atomic.AddInt64(&s.inflight, -1)
+
+	group, key := req.GetGroup(), req.GetKey()
+	resp := &pb.SetResponse{}
+	s.logRequest("Set", group, key)
+
+	if key == "" || group == "" {
+		return resp, toStatus(ErrInvalidRequest)
+	}
+
+	g := GetGroup(group)
+	if g == nil {
+		return resp, toStatus(fmt.Errorf("%w: %s", ErrGroupNotFound, group))
+	}
+	g.Stats.ServerRequests.Add(1)
+	if err := s.checkValueSize(group, key, len(req.GetValue())); err != nil {
+		return resp, toStatus(err)
+	}
+	value := ByteView{b: req.GetValue()}
+	if req.GetExpire() != 0 {
+		value.e = time.Unix(0, req.GetExpire())
+	}
+	g.populateCache(key, value, g.mainCache)
+	return resp, nil
+}
+
+// Start 启动 Cache 服务，开始监听并注册到服务发现系统后立即返回，不会阻塞在 Serve 上
+// ctx 只作用于启动过程（例如注册到 etcd），Start 返回之后取消 ctx 不会停止服务，停止服务请使用 Shutdown
+// Shutdown 之后可以再次调用 Start 重新启动
+func (s *Server) Start(ctx context.Context) error {
+	s.lifecycle.Lock()
+	defer s.lifecycle.Unlock()
+
+	s.mu.RLock()
+	running := s.Status
+	s.mu.RUnlock()
+	if running {
 		return fmt.Errorf("server %s is already started", s.Addr)
 	}
 
 	// ------------启动服务----------------
-	// 1. 设置 status = true 表示服务器已经在运行
-	// 2. 初始化 stop channel，用于通知 registry stop keepalive
-	// 3. 初始化 tcp socket 并开始监听
-	// 4. 注册 rpc 服务至 grpc，这样 grpc 收到 request 可以分发给 server 处理
-	// 5. 将自己的服务名/Host地址注册至 etcd，这样 client 就可以通过 etcd 获取服务 Host 地址进行通信；这样做的好处是：client 只需要知道服务名称以及 etcd 的 Host 就可以获取
+	// 1. 初始化 tcp socket 并开始监听
+	// 2. 注册 rpc 服务至 grpc，在后台处理请求，这样 grpc 收到 request 可以分发给 server 处理
+	// 3. 将自己的服务名/Host地址注册至 etcd，这样 client 就可以通过 etcd 获取服务 Host 地址进行通信；这样做的好处是：client 只需要知道服务名称以及 etcd 的 Host 就可以获取
 	// 指定服务的 IP，无需将它们写死在 client 代码中
-	s.Status = true
-	s.stopsSignal = make(chan error)
-
+	// 4. 设置 status = true 表示服务器已经在运行，开始同步集群中的节点与缓存失效事件，并通知 Ready
 	port := strings.Split(s.Addr, ":")[1]
 	lis, err := net.Listen("tcp", ":"+port)
 	if err != nil {
 		return fmt.Errorf("failed to listen %s, error: %v", s.Addr, err)
 	}
-	grpcServer := grpc.NewServer()
+	grpcServer := grpc.NewServer(s.serverOptions()...)
 	pb.RegisterGroupCacheServer(grpcServer, s)
-
-	// 注册服务至 etcd
 	go func() {
-		// Register never return unless stop signal received (blocked)
-		err := serverregistrydiscover.Register("groupcache", s.Addr, s.stopsSignal)
-		if err != nil {
-			logger.Logger.Error(err.Error())
+		// Serve 在 Stop 或 GracefulStop 之后返回 nil，其他情况说明监听出现了致命错误
+		if err := grpcServer.Serve(lis); err != nil {
+			s.log.Error("serve failed", "err", err)
 		}
-		// close channel
-		close(s.stopsSignal)
-		// close tcp listen
-		err = lis.Close()
-		if err != nil {
-			logger.Logger.Error(err.Error())
-		}
-		logger.Logger.Infof("[%s] Revoke service and close tcp socket ok.", s.Addr)
 	}()
 
-	logger.Logger.Infof("[%s] register service ok\n", s.Addr)
-	s.mu.Unlock()
-	// Serve接受侦听器列表上的传入连接，为每个连接创建一个新的ServerTransport和服务Goroutine。
-	// 服务Goroutines读取GRPC请求，然后调用注册的处理程序来回复它们。当lis.Accept失败并出现致命错误时，Serve返回。当此方法返回时，LIS将关闭。
-	// 除非调用Stop或GracefulStop，否则SERVE将返回非零错误。
-	if err := grpcServer.Serve(lis); s.Status && err != nil {
-		return fmt.Errorf("failed to serve %s, error: %v", s.Addr, err)
+	if err := s.registry.Register(ctx, s.Addr, s.Weight); err != nil {
+		grpcServer.Stop()
+		return fmt.Errorf("failed to register %s, error: %v", s.Addr, err)
+	}
+	s.log.Info("service registered")
+
+	// 监听 etcd 中注册的节点，自动维护一致性哈希环和 peer 连接
+	// 同时监听集群范围的缓存失效事件
+	s.mu.Lock()
+	s.Status = true
+	s.grpcServer = grpcServer
+	watchCtx, cancel := context.WithCancel(context.Background())
+	s.stopWatch = cancel
+	if s.MetricsAddr != "" {
+		s.startMetrics()
 	}
+	ready := s.ready
+	s.mu.Unlock()
+	go s.watchPeers(watchCtx)
+	go s.watchInvalidations(watchCtx)
+	close(ready)
 	return nil
 }
 
+// Ready 返回一个在 Start 完成后关闭的 channel，其他 goroutine 可以据此等待服务就绪
+// Shutdown 之后会换成一个新的 channel，在下一次 Start 完成后关闭
+func (s *Server) Ready() <-chan struct{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.ready
+}
+
+// serverOptions 返回创建 gRPC 服务使用的选项
+func (s *Server) serverOptions() []grpc.ServerOption {
+	opts := []grpc.ServerOption{
+		// 还原调用方的 trace 上下文，为每个请求创建 server span
+		grpc.ChainUnaryInterceptor(traceUnaryServer),
+		grpc.ChainStreamInterceptor(traceStreamServer),
+	}
+	// Set 请求携带完整的 value，接收上限需要容纳 MaxValueBytes 大小的值
+	if s.MaxValueBytes > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(int(s.MaxValueBytes)+streamChunkSize))
+	}
+	return opts
+}
+
+// startMetrics 在 MetricsAddr 上启动暴露 Prometheus 指标的 HTTP 服务，调用方需持有 s.mu
+// 指标服务只用于观测，启动失败只记录日志，不影响缓存服务
+func (s *Server) startMetrics() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", MetricsHandler())
+	srv := &http.Server{Addr: s.MetricsAddr, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	s.metricsSrv = srv
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			s.log.Error("metrics server stopped", "metrics_addr", s.MetricsAddr, "err", err)
+		}
+	}()
+	s.log.Info("serve metrics", "metrics_addr", s.MetricsAddr)
+}
+
 // SetPeers 将各个远端主机 IP 配置到 Server 里
 // 这样 Server 就可以 Pick 它们了
 // 注意：此操作是覆写操作，peersIP 必须满足 x.x.x.x:port 的格式
+// 仍然存在的 peer 会继续复用已有的连接，被移除的 peer 的连接会被关闭
+// Server 启动后会自动从 etcd 同步节点，通常不需要手动调用 SetPeers
 func (s *Server) SetPeers(peersAddr []string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	s.consHash = consistenthash.NewConsistentHash(defaultReplicas, nil)
-	s.consHash.AddTruthNode(peersAddr...)
-	s.clients = make(map[string]*client)
-
 	for _, peersAddr := range peersAddr {
 		if !utils.ValidPerrAddr(peersAddr) {
 			panic(fmt.Sprintf("[peer %s] invalid address format, it shoulb be x.x.x.x:port", peersAddr))
 		}
-		// groupcache/localhost:8000
-		service := fmt.Sprintf("groupcache/%s", peersAddr)
-		// client {name string}  (c *client) Fetch(key string) ([]byte, error)
-		s.clients[peersAddr] = NewClient(service)
 	}
+
+	cli, err := s.etcdClient()
+	if err != nil {
+		s.log.Error("create etcd client failed", "err", err)
+		return
+	}
+
+	clients := make(map[string]*client, len(peersAddr))
+	for _, peersAddr := range peersAddr {
+		if c, ok := s.clients[peersAddr]; ok {
+			clients[peersAddr] = c
+			continue
+		}
+		c, err := s.newClient(peersAddr, cli)
+		if err != nil {
+			s.log.Error("dial peer failed", "peer", peersAddr, "err", err)
+			continue
+		}
+		clients[peersAddr] = c
+	}
+	// 关闭已经不在 peer 列表中的连接
+	for addr, c := range s.clients {
+		if _, ok := clients[addr]; !ok {
+			c.close()
+		}
+	}
+	s.clients = clients
+	// 增量更新哈希环：移出已经不在列表中的节点，加入新节点（已在环上的节点会被忽略）
+	for _, member := range s.Placement.Members() {
+		if _, ok := clients[member]; !ok {
+			s.Placement.RemovePeer(member)
+		}
+	}
+	added := make([]string, 0, len(clients))
+	for addr := range clients {
+		added = append(added, addr)
+	}
+	s.Placement.AddTruthNode(added...)
 }
 
-// Pick 根据一致性哈希选举出 key 应该存放在的 cache
-// return false 代表从本地获取 cache
-func (s *Server) Pick(key string) (Fetcher, bool) {
+// newClient 建立到 peer 的连接，连接的日志携带 peer 字段，调用方需持有 s.mu
+func (s *Server) newClient(addr string, cli *clientv3.Client) (*client, error) {
+	// groupcache/localhost:8000
+	c, err := NewClient(fmt.Sprintf("groupcache/%s", addr), cli)
+	if err != nil {
+		return nil, err
+	}
+	c.log = s.log.With("peer", addr)
+	c.fetchTimeout = s.fetchTimeout
+	c.maxValueBytes = s.MaxValueBytes
+	return c, nil
+}
+
+// etcdClient 返回共享的 etcd client，第一次调用时创建，调用方需持有 s.mu
+func (s *Server) etcdClient() (*clientv3.Client, error) {
+	if s.etcdCli == nil {
+		cli, err := clientv3.New(s.etcdConfig)
+		if err != nil {
+			return nil, err
+		}
+		s.etcdCli = cli
+	}
+	return s.etcdCli, nil
+}
+
+// watchPeers 监听 etcd 中 groupcache 服务下的节点，增量地将加入的节点放入哈希环，将离开或租约过期的节点移出哈希环
+// watch 建立失败或者异常结束时，在 ctx 取消之前按退避时间重新监听
+func (s *Server) watchPeers(ctx context.Context) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	if !s.Status {
+		s.mu.Unlock()
+		return
+	}
+	cli, err := s.etcdClient()
+	s.mu.Unlock()
+	if err != nil {
+		s.log.Error("create etcd client failed", "err", err)
+		return
+	}
 
-	peerAddr := s.consHash.GetTruthNode(key)
-	// Pick itself
-	if peerAddr == s.Addr {
-		logger.Logger.Infof("oohhh! pick myself, i am %s\n", s.Addr)
-		return nil, false
+	delay := minRewatchBackoff
+	for restart := false; ; restart = true {
+		watched, err := s.watchPeersOnce(ctx, cli, restart)
+		// Shutdown 取消 ctx 导致的结束不是错误，直接退出
+		if ctx.Err() != nil {
+			return
+		}
+		if watched {
+			delay = minRewatchBackoff
+		}
+		if err != nil {
+			s.log.Error("watch peers failed, retrying", "err", err, "retry_in", delay)
+		} else {
+			s.log.Warn("watch peers closed, retrying", "retry_in", delay)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxRewatchBackoff {
+			delay = maxRewatchBackoff
+		}
 	}
+}
+
+// watchPeersOnce 建立一次节点 watch 并处理事件直到 channel 关闭，watched 表示 watch 是否建立成功
+// restart 为 true 时，中断期间可能错过了节点离开的事件，而新的 watch 只会重新推送仍然注册着的节点，
+// 因此还要对照最新的注册列表移出已经离开的节点
+func (s *Server) watchPeersOnce(ctx context.Context, cli *clientv3.Client, restart bool) (watched bool, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	logger.Logger.Info("[cache %s] pick remote peer: %s\n", s.Addr, peerAddr)
-	return s.clients[peerAddr], true
+	wch, err := serverregistrydiscover.Watch(ctx, cli, "groupcache")
+	if err != nil {
+		return false, err
+	}
+	if restart {
+		// 在 watch 建立之后获取注册列表，之后离开的节点由 watch 推送，不会被遗漏
+		registered, err := serverregistrydiscover.List(ctx, cli, "groupcache")
+		if err != nil {
+			return true, err
+		}
+		addrs := make([]string, 0, len(registered))
+		for key := range registered {
+			addrs = append(addrs, strings.TrimPrefix(key, "groupcache/"))
+		}
+		s.log.Info("watch peers restarted", "registered", len(addrs), "removed", s.removeStalePeers(addrs))
+	}
+	for updates := range wch {
+		for _, up := range updates {
+			// key 的格式为 groupcache/ip:port
+			addr := strings.TrimPrefix(up.Key, "groupcache/")
+			switch up.Op {
+			case endpoints.Add:
+				s.addPeer(addr, serverregistrydiscover.ParseMetadata(up.Endpoint.Metadata).Weight)
+			case endpoints.Delete:
+				s.removePeer(addr)
+			}
+		}
+	}
+	return true, nil
 }
 
-// Stop 停止 server 运行，如果 server 没有运行，这将是一个 no-op
-func (s *Server) Stop() {
+// removeStalePeers 将哈希环上不在 registered 中的节点移出，返回移出的节点数，本节点自身不会被移出
+func (s *Server) removeStalePeers(registered []string) int {
+	keep := make(map[string]bool, len(registered)+1)
+	keep[s.Addr] = true
+	for _, addr := range registered {
+		keep[addr] = true
+	}
+	n := 0
+	for _, member := range s.Placement.Members() {
+		if !keep[member] {
+			s.removePeer(member)
+			n++
+		}
+	}
+	return n
+}
+
+// watchInvalidations 监听集群范围的失效事件并应用到本节点的缓存
+func (s *Server) watchInvalidations(ctx context.Context) {
+	s.mu.Lock()
+	if !s.Status {
+		s.mu.Unlock()
+		return
+	}
+	cli, err := s.etcdClient()
+	s.mu.Unlock()
+	if err != nil {
+		s.log.Error("create etcd client failed", "err", err)
+		return
+	}
+
+	err = serverregistrydiscover.WatchInvalidations(ctx, cli, s.log, applyInvalidation, func() {
+		// 可能错过了失效事件，保守起见清空所有 Group
+		mu.RLock()
+		defer mu.RUnlock()
+		for _, g := range groups {
+			g.bumpGeneration()
+		}
+	})
+	if err != nil && ctx.Err() == nil {
+		s.log.Error("watch invalidations failed", "err", err)
+	}
+}
+
+// applyInvalidation 将失效事件应用到本节点对应的 Group
+func applyInvalidation(inv serverregistrydiscover.Invalidation) {
+	g := GetGroup(inv.Group)
+	if g == nil {
+		return
+	}
+	switch inv.Kind {
+	case serverregistrydiscover.InvalidatePrefix:
+		g.invalidatePrefix(inv.Prefix)
+	case serverregistrydiscover.InvalidateGeneration:
+		g.bumpGeneration()
+	default:
+		g.log.Warn("unknown invalidation kind", "kind", inv.Kind)
+	}
+}
+
+// InvalidatePrefix 通知集群中所有节点删除 group 中以 prefix 开头的 key
+func (s *Server) InvalidatePrefix(ctx context.Context, group, prefix string) error {
+	return s.publishInvalidation(ctx, serverregistrydiscover.Invalidation{
+		Group:  group,
+		Kind:   serverregistrydiscover.InvalidatePrefix,
+		Prefix: prefix,
+	})
+}
+
+// BumpGeneration 通知集群中所有节点清空 group 的全部缓存，例如数据库表结构迁移之后
+func (s *Server) BumpGeneration(ctx context.Context, group string) error {
+	return s.publishInvalidation(ctx, serverregistrydiscover.Invalidation{
+		Group: group,
+		Kind:  serverregistrydiscover.InvalidateGeneration,
+	})
+}
+
+func (s *Server) publishInvalidation(ctx context.Context, inv serverregistrydiscover.Invalidation) error {
+	s.mu.Lock()
+	cli, err := s.etcdClient()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return serverregistrydiscover.PublishInvalidation(ctx, cli, inv)
+}
+
+// addPeer 将新加入的节点按权重放入哈希环并建立连接，已存在的节点将被忽略
+func (s *Server) addPeer(addr string, weight int) {
+	if !utils.ValidPerrAddr(addr) {
+		s.log.Warn("invalid peer address, ignored", "peer", addr)
+		return
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	// Server 已经停止，忽略停止前残留的事件
 	if !s.Status {
 		return
 	}
-	// 发送停止 keepAlive 的信号，因为该节点要退出了，不需要再发送心跳探测了
-	s.stopsSignal <- nil
+	if _, ok := s.clients[addr]; ok {
+		return
+	}
+	cli, err := s.etcdClient()
+	if err != nil {
+		s.log.Error("create etcd client failed", "err", err)
+		return
+	}
+	c, err := s.newClient(addr, cli)
+	if err != nil {
+		s.log.Error("dial peer failed", "peer", addr, "err", err)
+		return
+	}
+	if s.clients == nil {
+		s.clients = make(map[string]*client)
+	}
+	s.clients[addr] = c
+	if wp, ok := s.Placement.(consistenthash.WeightedPlacement); ok {
+		wp.AddWeightedTruthNode(map[string]int{addr: weight})
+	} else {
+		s.Placement.AddTruthNode(addr)
+	}
+	s.log.Info("peer joined", "peer", addr, "weight", weight)
+}
+
+// removePeer 将离开的节点移出哈希环并关闭连接
+func (s *Server) removePeer(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.clients[addr]
+	if !ok {
+		return
+	}
+	c.close()
+	delete(s.clients, addr)
+	s.Placement.RemovePeer(addr)
+	s.log.Info("peer left", "peer", addr)
+}
+
+// Pick 根据一致性哈希选举出 key 应该存放在的 cache
+// return false 代表从本地获取 cache
+func (s *Server) Pick(ctx context.Context, key string) (Fetcher, bool) {
+	_, span := startSpan(ctx, "groupcache.Server.Pick", trace.SpanKindInternal, keyAttr(key))
+	defer span.End()
+
+	fetcher, ok := s.pick(key, "")
+	if ok {
+		span.SetAttributes(attrPeer.String(fetcher.(*client).name))
+	} else {
+		span.SetAttributes(attrPeer.String(s.Addr))
+	}
+	return fetcher, ok
+}
+
+// PickNext 返回排除 failed 之后 key 的 owner，Placement 不支持排除查找时返回 false
+func (s *Server) PickNext(ctx context.Context, key string, failed Fetcher) (Fetcher, bool) {
+	if _, ok := s.Placement.(consistenthash.ExcludingPlacement); !ok {
+		return nil, false
+	}
+	s.mu.RLock()
+	var failedAddr string
+	for addr, c := range s.clients {
+		if Fetcher(c) == failed {
+			failedAddr = addr
+			break
+		}
+	}
+	s.mu.RUnlock()
+	if failedAddr == "" {
+		return nil, false
+	}
+	return s.pick(key, failedAddr)
+}
+
+// pick 选择 key 的 owner，连接不可用或处于熔断状态的 peer 会被临时剔除，它们负责的 key 转移到哈希环上的下一个节点
+// Placement 不支持排除查找时，owner 被剔除则由本节点负责
+func (s *Server) pick(key string, failed string) (Fetcher, bool) {
+	exclude := s.ejected()
+	if failed != "" {
+		if exclude == nil {
+			exclude = make(map[string]bool, 1)
+		}
+		exclude[failed] = true
+	}
+
+	var peerAddr string
+	ep, excluding := s.Placement.(consistenthash.ExcludingPlacement)
+	bp, bounded := s.Placement.(consistenthash.BoundedPlacement)
+	switch {
+	case len(exclude) > 0 && excluding:
+		peerAddr = ep.GetTruthNodeExcluding(key, exclude)
+	case bounded && s.LoadFactor > 1:
+		peerAddr = bp.GetTruthNodeBounded(key, s.LoadFactor, s.loads())
+	default:
+		peerAddr = s.Placement.GetTruthNode(key)
+	}
+	// Pick itself
+	if peerAddr == s.Addr || peerAddr == "" {
+		return nil, false
+	}
+	if exclude[peerAddr] {
+		s.hotLog.Warn("peer unavailable, get locally", "peer", peerAddr)
+		return nil, false
+	}
+
+	s.mu.RLock()
+	c, ok := s.clients[peerAddr]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	return c, true
+}
+
+// ejected 返回连接不可用或处于熔断状态的 peer，没有时返回 nil
+func (s *Server) ejected() map[string]bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var exclude map[string]bool
+	for addr, c := range s.clients {
+		if addr == s.Addr || c.available() {
+			continue
+		}
+		if exclude == nil {
+			exclude = make(map[string]bool)
+		}
+		exclude[addr] = true
+	}
+	return exclude
+}
+
+// GetAll 返回除自身以外所有节点的 Fetcher
+func (s *Server) GetAll() []Fetcher {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	fetchers := make([]Fetcher, 0, len(s.clients))
+	for addr, c := range s.clients {
+		if addr != s.Addr {
+			fetchers = append(fetchers, c)
+		}
+	}
+	return fetchers
+}
+
+// loads 返回各个节点当前的负载：远端节点为本节点发往它的进行中请求数，本节点为正在处理的远端请求数
+func (s *Server) loads() map[string]int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	loads := make(map[string]int64, len(s.clients)+1)
+	for addr, c := range s.clients {
+		loads[addr] = atomic.LoadInt64(&c.inflight)
+	}
+	loads[s.Addr] = atomic.LoadInt64(&s.inflight)
+	return loads
+}
+
+// Shutdown 优雅地停止服务：
+// 1. 从服务发现系统中注销，其他节点不再把请求路由到本节点
+// 2. 停止同步节点与失效事件，关闭指标服务
+// 3. 通过 GracefulStop 拒绝新的请求并等待进行中的请求处理完成，ctx 先结束时强制断开所有连接并返回 ctx.Err()
+// 4. 关闭所有 peer 的长连接并清空哈希环
+// 服务没有启动时直接返回 nil
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lifecycle.Lock()
+	defer s.lifecycle.Unlock()
+
+	s.mu.Lock()
+	if !s.Status {
+		s.mu.Unlock()
+		return nil
+	}
 	s.Status = false
-	s.clients = nil // 清空一致性哈希信息，帮助 GC 进行垃圾回收
-	s.consHash = nil
+	grpcServer, stopWatch, metricsSrv := s.grpcServer, s.stopWatch, s.metricsSrv
+	s.grpcServer, s.stopWatch, s.metricsSrv = nil, nil, nil
+	s.mu.Unlock()
+
+	var errs []error
+	if err := s.registry.Deregister(ctx, s.Addr); err != nil {
+		errs = append(errs, fmt.Errorf("failed to deregister %s, error: %v", s.Addr, err))
+	}
+	stopWatch()
+	if metricsSrv != nil {
+		if err := metricsSrv.Shutdown(ctx); err != nil {
+			metricsSrv.Close()
+		}
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		grpcServer.Stop()
+		<-stopped
+		errs = append(errs, ctx.Err())
+	}
+
+	// 进行中的请求都已经结束，关闭所有 peer 的长连接，并清空哈希环
+	s.mu.Lock()
+	for _, c := range s.clients {
+		c.close()
+	}
+	for _, member := range s.Placement.Members() {
+		s.Placement.RemovePeer(member)
+	}
+	if s.etcdCli != nil {
+		s.etcdCli.Close()
+		s.etcdCli = nil
+	}
+	s.clients = nil // 清空 peer 信息，帮助 GC 进行垃圾回收
+	s.ready = make(chan struct{})
+	s.mu.Unlock()
+	s.log.Info("service stopped")
+	return errors.Join(errs...)
+}
+
+// Stop 停止服务，等同于超时时间为 defaultShutdownTimeout 的 Shutdown
+func (s *Server) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultShutdownTimeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		s.log.Error("shutdown failed", "err", err)
+	}
 }
 
 // 测试 Server 是否实现了 Picker 接口
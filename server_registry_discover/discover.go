@@ -1,7 +1,10 @@
 package serverregistrydiscover
 
 import (
+	"context"
+
 	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/naming/endpoints"
 	"go.etcd.io/etcd/client/v3/naming/resolver"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
@@ -9,7 +12,8 @@ import (
 
 // EtcdDial 向 grpc 请求一个服务
 // 通过提供一个 etcd client 和 service name 即可获取连接
-func EtcdDial(c *clientv3.Client, service string) (*grpc.ClientConn, error) {
+// 默认非阻塞建立连接，需要阻塞等待连接 up 时可以传入 grpc.WithBlock()，此时 ctx 取消或超时后将停止等待
+func EtcdDial(ctx context.Context, c *clientv3.Client, service string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
 	// NewBuilder 创建一个解析器生成器。用于解析客户端发来的请求路径，从而确认要连接的对象
 	etcdResolver, err := resolver.NewBuilder(c)
 	if err != nil {
@@ -18,10 +22,29 @@ func EtcdDial(c *clientv3.Client, service string) (*grpc.ClientConn, error) {
 
 	// Dial 创建到给定目标的客户端连接
 	// WithResolvers 允许在 ClientConn 本地注册一系列解析器实现，而无需通过 resolver.Register 进行全局注册。它们将仅与当前 Dial 使用的方案进行匹配，并优先于全局注册。
-	return grpc.Dial(
-		"etcd:///"+service,
+	opts = append([]grpc.DialOption{
 		grpc.WithResolvers(etcdResolver),
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithBlock(), //阻塞等待直至连接 up
-	)
+	}, opts...)
+	return grpc.DialContext(ctx, "etcd:///"+service, opts...)
+}
+
+// Watch 监听 etcd 中 service 下注册的所有节点
+// 返回的 channel 第一次推送当前已注册的全部节点（Add），之后推送节点的加入（Add）与离开（Delete，包括租约过期）
+// ctx 取消后 channel 会被关闭
+func Watch(ctx context.Context, c *clientv3.Client, service string) (endpoints.WatchChannel, error) {
+	em, err := endpoints.NewManager(c, service)
+	if err != nil {
+		return nil, err
+	}
+	return em.NewWatchChannel(ctx)
+}
+
+// List 返回 etcd 中 service 下当前注册的所有节点，map 的 key 为 service/addr
+func List(ctx context.Context, c *clientv3.Client, service string) (endpoints.Key2EndpointMap, error) {
+	em, err := endpoints.NewManager(c, service)
+	if err != nil {
+		return nil, err
+	}
+	return em.List(ctx)
 }
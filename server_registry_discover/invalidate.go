@@ -0,0 +1,106 @@
+package serverregistrydiscover
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/1055373165/groupcache/logger"
+
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// invalidate 模块基于 etcd 提供集群范围的缓存失效广播
+// 任意节点将失效事件写入 etcd，所有节点通过 Watch 收到事件后各自清理本地缓存
+//   - 顺序：每个 Group 的事件写入同一个 key，etcd 按 revision 顺序投递同一个 key 的所有修改
+//   - 幂等：节点记录已处理的最大 revision，重复投递（例如断线重连后）的事件会被忽略
+//   - 不丢失：断线重连后从上次处理的 revision 继续监听；若这段历史已被 etcd 压缩，回调 onReset 由调用方做全量失效
+
+// invalidationPrefix 失效事件在 etcd 中的 key 前缀，不能以 "groupcache/" 开头，否则会被当作服务节点
+const invalidationPrefix = "groupcache-invalidation/"
+
+// InvalidationKind 失效事件的类型
+type InvalidationKind string
+
+const (
+	// InvalidatePrefix 删除 Group 中所有以 Prefix 开头的 key
+	InvalidatePrefix InvalidationKind = "prefix"
+	// InvalidateGeneration 递增 Group 的代数，清空 Group 的全部缓存
+	InvalidateGeneration InvalidationKind = "generation"
+)
+
+// Invalidation 是一次缓存失效事件
+type Invalidation struct {
+	Group  string           `json:"group"`
+	Kind   InvalidationKind `json:"kind"`
+	Prefix string           `json:"prefix,omitempty"`
+}
+
+// PublishInvalidation 发布一次失效事件，事件会被所有节点（包括自己）按顺序处理
+func PublishInvalidation(ctx context.Context, c *clientv3.Client, inv Invalidation) error {
+	if inv.Group == "" {
+		return errors.New("invalidation group is required")
+	}
+	b, err := json.Marshal(inv)
+	if err != nil {
+		return err
+	}
+	_, err = c.Put(ctx, invalidationPrefix+inv.Group, string(b))
+	return err
+}
+
+// InvalidationWatcher 是 WatchInvalidations 用到的 etcd 客户端方法，*clientv3.Client 实现了这个接口
+type InvalidationWatcher interface {
+	Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error)
+	Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan
+}
+
+// rewatchInterval 是 watch 异常结束之后重新监听前的等待时间
+var rewatchInterval = time.Second
+
+// WatchInvalidations 从当前 revision 开始监听失效事件，并按 revision 顺序调用 apply，直到 ctx 被取消
+// 历史已被压缩、无法保证不丢失事件时调用 onReset
+func WatchInvalidations(ctx context.Context, c InvalidationWatcher, log logger.Interface, apply func(Invalidation), onReset func()) error {
+	resp, err := c.Get(ctx, invalidationPrefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		return err
+	}
+	// 已处理的最大 revision，更早的事件在节点启动前就已发生，由启动时的空缓存保证一致
+	applied := resp.Header.Revision
+
+	for ctx.Err() == nil {
+		wch := c.Watch(ctx, invalidationPrefix, clientv3.WithPrefix(), clientv3.WithRev(applied+1))
+		for wresp := range wch {
+			if err := wresp.Err(); err != nil {
+				if errors.Is(err, rpctypes.ErrCompacted) {
+					log.Warn("invalidation history compacted, reset all caches", "compact_revision", wresp.CompactRevision)
+					onReset()
+					applied = wresp.CompactRevision - 1
+				} else {
+					log.Error("watch invalidations failed", "err", err)
+				}
+				break
+			}
+			for _, ev := range wresp.Events {
+				if ev.Type != clientv3.EventTypePut || ev.Kv.ModRevision <= applied {
+					continue
+				}
+				applied = ev.Kv.ModRevision
+				var inv Invalidation
+				if err := json.Unmarshal(ev.Kv.Value, &inv); err != nil {
+					log.Error("bad invalidation event", "key", string(ev.Kv.Key), "err", err)
+					continue
+				}
+				apply(inv)
+			}
+		}
+		// watch 异常结束，稍后从 applied 之后继续监听
+		select {
+		case <-ctx.Done():
+		case <-time.After(rewatchInterval):
+		}
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,118 @@
+package serverregistrydiscover
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/1055373165/groupcache/logger"
+)
+
+// fakeWatcher 是用于测试的 InvalidationWatcher，每次 Watch 都把起始 revision 和事件 channel 交给测试
+type fakeWatcher struct {
+	rev     int64
+	watches chan fakeWatch
+}
+
+type fakeWatch struct {
+	rev int64
+	ch  chan clientv3.WatchResponse
+}
+
+func (w *fakeWatcher) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	return &clientv3.GetResponse{Header: &etcdserverpb.ResponseHeader{Revision: w.rev}}, nil
+}
+
+func (w *fakeWatcher) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	ch := make(chan clientv3.WatchResponse)
+	w.watches <- fakeWatch{rev: clientv3.OpGet(key, opts...).Rev(), ch: ch}
+	return ch
+}
+
+func putEvent(t *testing.T, rev int64, prefix string) *clientv3.Event {
+	b, err := json.Marshal(Invalidation{Group: "scores", Kind: InvalidatePrefix, Prefix: prefix})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &clientv3.Event{
+		Type: clientv3.EventTypePut,
+		Kv:   &mvccpb.KeyValue{Key: []byte(invalidationPrefix + "scores"), Value: b, ModRevision: rev},
+	}
+}
+
+func TestWatchInvalidations(t *testing.T) {
+	defer func(d time.Duration) { rewatchInterval = d }(rewatchInterval)
+	rewatchInterval = time.Millisecond
+
+	w := &fakeWatcher{rev: 10, watches: make(chan fakeWatch, 1)}
+	applied := make(chan string, 10)
+	resets := make(chan struct{}, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- WatchInvalidations(ctx, w, logger.Nop(), func(inv Invalidation) {
+			applied <- inv.Prefix
+		}, func() {
+			resets <- struct{}{}
+		})
+	}()
+
+	expect := func(want ...string) {
+		t.Helper()
+		for _, prefix := range want {
+			select {
+			case got := <-applied:
+				if got != prefix {
+					t.Fatalf("expect invalidation %q, but got %q", prefix, got)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("expect invalidation %q", prefix)
+			}
+		}
+		select {
+		case got := <-applied:
+			t.Fatalf("unexpected invalidation %q", got)
+		default:
+		}
+	}
+
+	// 从启动时的 revision 之后开始监听，按 revision 顺序应用
+	watch := <-w.watches
+	if watch.rev != 11 {
+		t.Fatalf("expect watch from revision 11, but got %d", watch.rev)
+	}
+	watch.ch <- clientv3.WatchResponse{Events: []*clientv3.Event{putEvent(t, 11, "a"), putEvent(t, 12, "b")}}
+	watch.ch <- clientv3.WatchResponse{Events: []*clientv3.Event{
+		{Type: clientv3.EventTypeDelete, Kv: &mvccpb.KeyValue{ModRevision: 13}},
+		{Type: clientv3.EventTypePut, Kv: &mvccpb.KeyValue{Value: []byte("{"), ModRevision: 14}},
+	}}
+	// 重复投递的事件被忽略
+	watch.ch <- clientv3.WatchResponse{Events: []*clientv3.Event{putEvent(t, 12, "b"), putEvent(t, 15, "c")}}
+	expect("a", "b", "c")
+
+	// 历史被压缩时全量失效，并从压缩点继续监听
+	watch.ch <- clientv3.WatchResponse{CompactRevision: 20}
+	select {
+	case <-resets:
+	case <-time.After(time.Second):
+		t.Fatal("expect reset after compaction")
+	}
+	watch = <-w.watches
+	if watch.rev != 20 {
+		t.Fatalf("expect watch from compact revision 20, but got %d", watch.rev)
+	}
+	watch.ch <- clientv3.WatchResponse{Events: []*clientv3.Event{putEvent(t, 20, "d")}}
+	expect("d")
+
+	cancel()
+	close(watch.ch)
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expect context.Canceled, but got %v", err)
+	}
+}
@@ -2,8 +2,10 @@ package serverregistrydiscover
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
-	"log"
+	"math"
+	"sync"
 	"time"
 
 	"github.com/1055373165/groupcache/logger"
@@ -20,63 +22,157 @@ var (
 	}
 )
 
+// DefaultLeaseTTL 是服务注册的默认租约时长，节点异常退出后最多经过这段时间被移出
+const DefaultLeaseTTL = 5 * time.Second
+
+// Metadata 是节点注册时随地址一起发布的元数据，其他节点通过 Watch 获取
+type Metadata struct {
+	Weight int `json:"weight"` // 节点容量权重，决定其在一致性哈希环上的虚拟节点数
+}
+
+// ParseMetadata 解析 endpoints.Endpoint 中的元数据
+// etcd 中以 JSON 存储元数据，读取后得到的是 map[string]interface{}，因此需要重新编解码
+func ParseMetadata(v interface{}) Metadata {
+	var md Metadata
+	if v == nil {
+		return md
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return md
+	}
+	_ = json.Unmarshal(b, &md)
+	return md
+}
+
 // etcdAdd 以租约模式添加一对kv 至 etcd
-func etcdAdd(client *clientv3.Client, lid clientv3.LeaseID, service string, addr string) error {
+func etcdAdd(ctx context.Context, client *clientv3.Client, lid clientv3.LeaseID, service string, addr string, md Metadata) error {
 	em, err := endpoints.NewManager(client, service)
 	if err != nil {
 		return err
 	}
-	//return em.AddEndpoint(c.Ctx(), service+"/"+addr, endpoints.Endpoint{Addr: addr})
-	return em.AddEndpoint(client.Ctx(), service+"/"+addr, endpoints.Endpoint{Addr: addr}, clientv3.WithLease(lid))
+	return em.AddEndpoint(ctx, service+"/"+addr, endpoints.Endpoint{Addr: addr, Metadata: md}, clientv3.WithLease(lid))
+}
+
+// Registration 是一个已经注册到 etcd 的服务，租约在后台自动续约，Close 时撤销租约并删除注册信息
+type Registration struct {
+	cli     *clientv3.Client
+	service string
+	addr    string
+	md      Metadata
+	ttl     int64 // 租约时长（秒）
+	log     logger.Interface
+
+	mu     sync.Mutex
+	lease  clientv3.LeaseID
+	cancel context.CancelFunc // 停止续约
+	done   chan struct{}      // 续约协程退出后关闭
 }
 
-// Register 注册一个服务至 etcd
-// 注意 Register 将不会 return（如果没有 error 的话）
-func Register(service string, addr string, stop chan error) error {
-	// 使用默认配置创建一个 etcd client
-	cli, err := clientv3.New(DefaultEtcdConfig)
+// NewRegistration 使用 cfg 连接 etcd，以 leaseTTL 的租约注册 service/addr，返回后其他节点即可发现这个服务
+// 租约时长按秒向上取整，至少为 1 秒；ctx 只作用于注册过程，续约在 Close 之前一直在后台进行，续约异常记录到 log
+func NewRegistration(ctx context.Context, cfg clientv3.Config, leaseTTL time.Duration, service string, addr string, md Metadata, log logger.Interface) (*Registration, error) {
+	cli, err := clientv3.New(cfg)
 	if err != nil {
-		return fmt.Errorf("create etcd client falied: %v", err)
+		return nil, fmt.Errorf("create etcd client falied: %v", err)
+	}
+	ttl := int64(math.Ceil(leaseTTL.Seconds()))
+	if ttl < 1 {
+		ttl = 1
+	}
+	r := &Registration{
+		cli:     cli,
+		service: service,
+		addr:    addr,
+		md:      md,
+		ttl:     ttl,
+		log:     log,
+		done:    make(chan struct{}),
+	}
+	if err := r.register(ctx); err != nil {
+		cli.Close()
+		return nil, err
 	}
-	defer cli.Close()
 
-	// 调用客户端的 Grant 方法创建一个租约，配置 5s 过期
-	resp, err := cli.Grant(context.Background(), 5)
+	kctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	go r.keepAlive(kctx)
+	return r, nil
+}
+
+// register 创建一个新的租约，并将服务地址绑定到这个租约上
+func (r *Registration) register(ctx context.Context) error {
+	resp, err := r.cli.Grant(ctx, r.ttl)
 	if err != nil {
 		return fmt.Errorf("create lease failed: %v", err)
 	}
-	leaseId := resp.ID
-	// 注册服务
-	err = etcdAdd(cli, leaseId, service, addr)
-	if err != nil {
+	if err := etcdAdd(ctx, r.cli, resp.ID, r.service, r.addr, r.md); err != nil {
 		return fmt.Errorf("add etcd record failed: %v", err)
 	}
-	// 设置服务心跳检测
-	ch, err := cli.KeepAlive(context.Background(), leaseId)
-	if err != nil {
-		return fmt.Errorf("set keepalive failed: %v", err)
-	}
-	log.Printf("[%s] register service ok\n", addr)
+	r.mu.Lock()
+	r.lease = resp.ID
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *Registration) leaseID() clientv3.LeaseID {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lease
+}
+
+// keepAlive 持续为租约续约；租约丢失时（例如 etcd 长时间不可用导致租约过期）重新注册，直到 ctx 被取消
+func (r *Registration) keepAlive(ctx context.Context) {
+	defer close(r.done)
 	for {
-		select {
-		case err := <-stop:
-			if err != nil {
-				logger.Logger.Error(err.Error())
+		ch, err := r.cli.KeepAlive(ctx, r.leaseID())
+		if err == nil {
+			// 续约应答无需处理，channel 关闭说明续约停止
+			for range ch {
 			}
-			return err
-		case <-cli.Ctx().Done():
-			logger.Logger.Info("service closed")
-			return nil
-		case _, ok := <-ch:
-			// 监听租约
-			if !ok {
-				logger.Logger.Info("keepalive channel closed")
-				// 撤销撤销给定的租约。
-				_, err := cli.Revoke(context.Background(), leaseId)
-				return err
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		r.log.Warn("lease lost, register again", "service", r.service, "addr", r.addr)
+		for r.register(ctx) != nil {
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				return
 			}
-			logger.Logger.Info("Recv reply from service: %s/%s, ttl:%d", service, addr, resp.TTL)
 		}
+	}
+}
 
+// Close 停止续约并撤销租约，绑定在租约上的注册信息随之删除，其他节点会立即收到节点离开的事件
+func (r *Registration) Close(ctx context.Context) error {
+	r.cancel()
+	<-r.done
+	defer r.cli.Close()
+	if _, err := r.cli.Revoke(ctx, r.leaseID()); err != nil {
+		return fmt.Errorf("revoke lease failed: %v", err)
+	}
+	return nil
+}
+
+// Register 使用默认的 etcd 配置和租约时长注册一个服务至 etcd
+// 注意 Register 将不会 return（如果没有 error 的话），直到从 stop 收到信号后注销服务
+func Register(service string, addr string, md Metadata, stop chan error, log logger.Interface) error {
+	r, err := NewRegistration(context.Background(), DefaultEtcdConfig, DefaultLeaseTTL, service, addr, md, log)
+	if err != nil {
+		return err
+	}
+	log.Info("register service ok", "service", service, "addr", addr)
+
+	err = <-stop
+	if err != nil {
+		log.Error("service stopped with error", "service", service, "addr", addr, "err", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultLeaseTTL)
+	defer cancel()
+	if cerr := r.Close(ctx); err == nil {
+		err = cerr
 	}
+	return err
 }
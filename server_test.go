@@ -0,0 +1,494 @@
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/1055373165/groupcache/groupcachepb"
+	"github.com/1055373165/groupcache/logger"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newTestClient 在内存中启动 Server 的 gRPC 服务，返回连接到它的 client
+func newTestClient(t *testing.T, s *Server) *client {
+	c := newBufconnClient(t, s, s.serverOptions()...)
+	c.maxValueBytes = s.MaxValueBytes
+	return c
+}
+
+// newBufconnClient 在内存中启动 srv 的 gRPC 服务，返回连接到它的 client
+func newBufconnClient(t *testing.T, srv pb.GroupCacheServer, opts ...grpc.ServerOption) *client {
+	lis := bufconn.Listen(1 << 20)
+	grpcServer := grpc.NewServer(opts...)
+	pb.RegisterGroupCacheServer(grpcServer, srv)
+	go grpcServer.Serve(lis)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &client{name: "bufnet", conn: conn, grpcCli: pb.NewGroupCacheClient(conn), log: logger.Nop(), fetchTimeout: defaultFetchTimeout}
+}
+
+func TestFetchStream(t *testing.T) {
+	large := bytes.Repeat([]byte("groupcache"), 1<<20) // 10MB，超过 gRPC 默认的消息大小限制
+	NewGroup("stream", 64<<20, RetrieveFunc(func(key string) ([]byte, error) {
+		switch key {
+		case "large":
+			return large, nil
+		case "empty":
+			return []byte{}, nil
+		}
+		return []byte(key), nil
+	}))
+	defer DestroryGroup("stream")
+
+	s, err := NewServer("localhost:9999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, s)
+	ctx := context.Background()
+
+	for _, key := range []string{"small", "empty", "large"} {
+		view, err := c.Fetch(ctx, "stream", key)
+		if err != nil {
+			t.Fatalf("fetch %s failed: %v", key, err)
+		}
+		want := []byte(key)
+		if key == "large" {
+			want = large
+		} else if key == "empty" {
+			want = []byte{}
+		}
+		if !bytes.Equal(view.Bytes(), want) {
+			t.Fatalf("fetch %s got %d bytes, expect %d", key, view.Len(), len(want))
+		}
+	}
+
+	// 共享容量的缓存可以容纳超过 1/n 容量的 value
+	if _, ok := GetGroup("stream").mainCache.get("large"); !ok {
+		t.Fatal("expect large value to be cached")
+	}
+
+	s.MaxValueBytes = 1 << 20
+	if _, err := c.Fetch(ctx, "stream", "large"); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("expect value size limit error, but got %v", err)
+	}
+}
+
+func TestErrorPropagation(t *testing.T) {
+	errDB := errors.New("connection refused")
+	NewGroup("errors", 2<<10, RetrieveContextFunc(func(ctx context.Context, key string) ([]byte, error) {
+		switch key {
+		case "broken":
+			return nil, errDB
+		case "slow":
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return nil, ErrNotFound
+	}))
+	defer DestroryGroup("errors")
+
+	s, err := NewServer("localhost:9999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, s)
+	ctx := context.Background()
+
+	if _, err := c.Fetch(ctx, "errors", "nobody"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expect ErrNotFound, but got %v", err)
+	}
+	if _, err := c.Fetch(ctx, "missing", "key"); !errors.Is(err, ErrGroupNotFound) {
+		t.Fatalf("expect ErrGroupNotFound, but got %v", err)
+	}
+	if _, err := c.Fetch(ctx, "errors", ""); !errors.Is(err, ErrInvalidRequest) {
+		t.Fatalf("expect ErrInvalidRequest, but got %v", err)
+	}
+	_, err = c.Fetch(ctx, "errors", "broken")
+	if !errors.Is(err, ErrRetrieve) || !strings.Contains(err.Error(), errDB.Error()) {
+		t.Fatalf("expect ErrRetrieve with the original message, but got %v", err)
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.Fetch(timeoutCtx, "errors", "slow"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect context.DeadlineExceeded, but got %v", err)
+	}
+
+	results, err := c.FetchMany(ctx, "errors", []string{"nobody", "broken"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(results["nobody"].Err, ErrNotFound) || !errors.Is(results["broken"].Err, ErrRetrieve) {
+		t.Fatalf("unexpected batch results %v", results)
+	}
+	if _, err := c.FetchMany(ctx, "missing", []string{"key"}); !errors.Is(err, ErrGroupNotFound) {
+		t.Fatalf("expect ErrGroupNotFound from batch, but got %v", err)
+	}
+}
+
+func TestInternalStatus(t *testing.T) {
+	// gRPC 自身产生的 Internal 错误不是数据源故障，算作远端节点的问题
+	err := fromStatus(status.Error(codes.Internal, "grpc: error unmarshalling request"))
+	if errors.Is(err, ErrRetrieve) || !isPeerFailure(err) {
+		t.Fatalf("expect transport error to be a peer failure, but got %v", err)
+	}
+
+	// 数据源故障即使被再次包装，经过 gRPC 之后仍然是 ErrRetrieve
+	err = fromStatus(toStatus(fmt.Errorf("load Tom: %w", wrapRetrieveError(errors.New("connection refused")))))
+	if !errors.Is(err, ErrRetrieve) || isPeerFailure(err) {
+		t.Fatalf("expect ErrRetrieve, but got %v", err)
+	}
+}
+
+func TestFetchManyLargeBatch(t *testing.T) {
+	const size = 3 << 20
+	g := NewGroup("large-batch", 64<<20, RetrieveFunc(func(key string) ([]byte, error) {
+		if strings.HasPrefix(key, "missing") {
+			return nil, ErrNotFound
+		}
+		return bytes.Repeat([]byte(key), size), nil
+	}))
+	defer DestroryGroup("large-batch")
+
+	s, err := NewServer("localhost:9999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, s)
+
+	// 合计 9MB 的批量结果超过 gRPC 默认 4MB 的消息大小限制
+	results, err := c.FetchMany(context.Background(), "large-batch", []string{"a", "b", "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if r := results[key]; r.Err != nil || !bytes.Equal(r.Value.b, bytes.Repeat([]byte(key), size)) {
+			t.Fatalf("expect %d bytes of %s, but got %d bytes, err %v", size, key, r.Value.Len(), r.Err)
+		}
+		if _, ok := g.mainCache.get(key); !ok {
+			t.Fatalf("expect %s to be cached", key)
+		}
+	}
+
+	// 大量的 key 同样会让响应超过 4MB
+	keys := make([]string, 5000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("missing%04d%s", i, strings.Repeat("k", 1<<10))
+	}
+	results, err = c.FetchMany(context.Background(), "large-batch", keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(keys) || !errors.Is(results[keys[0]].Err, ErrNotFound) {
+		t.Fatalf("expect %d not found results, but got %d", len(keys), len(results))
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	s, err := NewServer("localhost:9999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, s)
+	if !c.available() {
+		t.Fatal("expect new client to be available")
+	}
+
+	for i := 0; i < breakerThreshold; i++ {
+		c.observe(status.Error(codes.Unavailable, "connection refused"), false)
+	}
+	if c.available() {
+		t.Fatal("expect circuit breaker to open after consecutive failures")
+	}
+
+	// 冷却结束后进入半开状态，再失败一次立即重新熔断
+	atomic.StoreInt64(&c.openUntil, time.Now().Add(-time.Second).UnixNano())
+	if !c.available() {
+		t.Fatal("expect client to be available after cooldown")
+	}
+	c.observe(status.Error(codes.Unavailable, "connection refused"), false)
+	if c.available() {
+		t.Fatal("expect circuit breaker to reopen on half-open failure")
+	}
+
+	// 远端节点正常返回的业务错误说明节点可用
+	c.observe(status.Error(codes.NotFound, "key not found"), false)
+	if !c.available() {
+		t.Fatal("expect circuit breaker to close after peer responded")
+	}
+}
+
+func TestCircuitBreakerCallerGaveUp(t *testing.T) {
+	s, err := NewServer("localhost:9999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, s)
+
+	// 调用方放弃请求不说明远端节点恢复了，之前的失败次数继续累计
+	for i := 0; i < breakerThreshold-1; i++ {
+		c.observe(status.Error(codes.DeadlineExceeded, "timeout"), true)
+	}
+	c.observe(status.Error(codes.Canceled, "canceled"), false)
+	c.observe(status.Error(codes.DeadlineExceeded, "caller timeout"), false)
+	if n := atomic.LoadInt64(&c.failures); n != breakerThreshold-1 {
+		t.Fatalf("expect %d failures, but got %d", breakerThreshold-1, n)
+	}
+	c.observe(status.Error(codes.DeadlineExceeded, "timeout"), true)
+	if c.available() {
+		t.Fatal("expect circuit breaker to open")
+	}
+}
+
+func TestCircuitBreakerDeadline(t *testing.T) {
+	NewGroup("slow", 2<<10, RetrieveContextFunc(func(ctx context.Context, key string) ([]byte, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}))
+	defer DestroryGroup("slow")
+
+	s, err := NewServer("localhost:9999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, s)
+
+	// 调用方自己的截止时间过短，不说明远端节点有问题
+	for i := 0; i < breakerThreshold; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		_, err := c.Fetch(ctx, "slow", "key")
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expect deadline exceeded, but got %v", err)
+		}
+	}
+	if !c.available() {
+		t.Fatal("expect caller deadlines not to open the circuit breaker")
+	}
+
+	// client 自己设置的超时说明远端节点响应过慢
+	c.fetchTimeout = 10 * time.Millisecond
+	for i := 0; i < breakerThreshold; i++ {
+		if _, err := c.Fetch(context.Background(), "slow", "key"); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expect deadline exceeded, but got %v", err)
+		}
+	}
+	if c.available() {
+		t.Fatal("expect fetch timeouts to open the circuit breaker")
+	}
+}
+
+func TestPickEjectsOpenPeer(t *testing.T) {
+	s, err := NewServer("localhost:9999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := newTestClient(t, s)
+	other := newTestClient(t, s)
+	s.clients = map[string]*client{"10.0.0.1:9999": peer, "10.0.0.2:9999": other}
+	s.Placement.AddTruthNode("10.0.0.1:9999", "10.0.0.2:9999")
+
+	var key string
+	for i := 0; ; i++ {
+		key = fmt.Sprintf("student:%d", i)
+		if f, ok := s.Pick(context.Background(), key); ok && f == Fetcher(peer) {
+			break
+		}
+	}
+	atomic.StoreInt64(&peer.openUntil, time.Now().Add(time.Minute).UnixNano())
+	if f, ok := s.Pick(context.Background(), key); !ok || f != Fetcher(other) {
+		t.Fatalf("expect key %s to move to the next peer while breaker open", key)
+	}
+	if f, ok := s.PickNext(context.Background(), key, other); ok {
+		t.Fatalf("expect no peer left for key %s, but got %v", key, f)
+	}
+}
+
+func TestDeleteRPC(t *testing.T) {
+	g := NewGroup("delete-rpc", 2<<10, RetrieveFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}))
+	defer DestroryGroup("delete-rpc")
+
+	s, err := NewServer("localhost:9999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, s)
+	ctx := context.Background()
+
+	g.populateCache("Tom", ByteView{b: []byte("630")}, g.mainCache)
+	g.populateCache("Tom", ByteView{b: []byte("630")}, g.hotCache)
+	if err := c.Remove(ctx, "delete-rpc", "Tom"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := g.mainCache.get("Tom"); ok {
+		t.Fatal("expect Tom to be removed from mainCache")
+	}
+	if _, ok := g.hotCache.get("Tom"); ok {
+		t.Fatal("expect Tom to be removed from hotCache")
+	}
+	if err := c.Remove(ctx, "missing", "Tom"); !errors.Is(err, ErrGroupNotFound) {
+		t.Fatalf("expect ErrGroupNotFound, but got %v", err)
+	}
+	if n := atomic.LoadInt64(&s.inflight); n != 0 {
+		t.Fatalf("expect no request in flight, but got %d", n)
+	}
+}
+
+func TestSetRPC(t *testing.T) {
+	g := NewGroup("set-rpc", 2<<10, RetrieveFunc(func(key string) ([]byte, error) {
+		return nil, errors.New("unexpected retrieve")
+	}))
+	defer DestroryGroup("set-rpc")
+
+	s, err := NewServer("localhost:9999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.MaxValueBytes = 16
+	c := newTestClient(t, s)
+	ctx := context.Background()
+
+	expire := time.Now().Add(time.Hour).Truncate(0)
+	if err := c.Set(ctx, "set-rpc", "Tom", ByteView{b: []byte("630"), e: expire}); err != nil {
+		t.Fatal(err)
+	}
+	view, ok := g.mainCache.get("Tom")
+	if !ok || view.String() != "630" || !view.Expire().Equal(expire) {
+		t.Fatalf("expect Tom in owner's mainCache with expire %v, but got %q %v %v", expire, view.String(), view.Expire(), ok)
+	}
+	if err := c.Set(ctx, "set-rpc", "Jack", ByteView{b: bytes.Repeat([]byte("x"), 17)}); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("expect ErrValueTooLarge, but got %v", err)
+	}
+	if err := c.Set(ctx, "missing", "Tom", ByteView{b: []byte("630")}); !errors.Is(err, ErrGroupNotFound) {
+		t.Fatalf("expect ErrGroupNotFound, but got %v", err)
+	}
+	if err := c.Set(ctx, "set-rpc", "", ByteView{b: []byte("630")}); !errors.Is(err, ErrInvalidRequest) {
+		t.Fatalf("expect ErrInvalidRequest, but got %v", err)
+	}
+}
+
+// chunkServer 是返回固定分段的 peer，用于模拟异常或恶意的 GetStream 响应
+type chunkServer struct {
+	pb.UnimplementedGroupCacheServer
+	chunks []*pb.GetChunk
+}
+
+func (s *chunkServer) GetStream(req *pb.GetRequest, stream pb.GroupCache_GetStreamServer) error {
+	for _, chunk := range s.chunks {
+		if err := stream.Send(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestFetchStreamRejectsBadSize(t *testing.T) {
+	tests := []struct {
+		name     string
+		chunks   []*pb.GetChunk
+		tooLarge bool
+	}{
+		{"negative size", []*pb.GetChunk{{Data: []byte("x"), Size: -1}}, false},
+		{"huge size", []*pb.GetChunk{{Data: []byte("x"), Size: 1 << 40}}, true},
+		{"first chunk over size", []*pb.GetChunk{{Data: []byte("xxxx"), Size: 2}}, false},
+		{"chunks over size", []*pb.GetChunk{{Data: []byte("xx"), Size: 4}, {Data: []byte("xx")}, {Data: []byte("xx")}}, false},
+		{"truncated", []*pb.GetChunk{{Data: []byte("xx"), Size: 4}}, false},
+	}
+	for _, tt := range tests {
+		c := newBufconnClient(t, &chunkServer{chunks: tt.chunks})
+		c.maxValueBytes = 1 << 20
+		_, err := c.Fetch(context.Background(), "stream", "key")
+		if err == nil {
+			t.Fatalf("%s: expect error", tt.name)
+		}
+		if errors.Is(err, ErrValueTooLarge) != tt.tooLarge {
+			t.Fatalf("%s: unexpected error %v", tt.name, err)
+		}
+	}
+}
+
+func TestPeerRequestNotForwarded(t *testing.T) {
+	var calls int32
+	g := NewGroup("no-forward", 2<<10, RetrieveFunc(func(key string) ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		return []byte(key), nil
+	}))
+	defer DestroryGroup("no-forward")
+
+	// 节点 B 的哈希环上只有节点 A，B 自己发起的请求都会转发给 A
+	a, err := NewServer("localhost:9998")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewServer("localhost:9999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.clients = map[string]*client{"localhost:9998": newTestClient(t, a)}
+	b.Placement.AddTruthNode("localhost:9998")
+	g.RegisterServer(b)
+
+	// A 转发给 B 的请求由 B 在本地处理，不会再转发回 A
+	toB := newTestClient(t, b)
+	ctx := context.Background()
+	if view, err := toB.Fetch(ctx, "no-forward", "Tom"); err != nil || view.String() != "Tom" {
+		t.Fatalf("expect Tom, but got %q %v", view.String(), err)
+	}
+	results, err := toB.FetchMany(ctx, "no-forward", []string{"Jack", "Sam"})
+	if err != nil || results["Jack"].Value.String() != "Jack" || results["Sam"].Value.String() != "Sam" {
+		t.Fatalf("expect Jack and Sam, but got %v %v", results, err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Fatalf("expect 3 local retrieves, but got %d", n)
+	}
+	if n := g.Stats.ServerRequests.Load(); n != 2 {
+		t.Fatalf("expect only the 2 requests to B, but got %d", n)
+	}
+	if n := g.Stats.PeerLoads.Load(); n != 0 {
+		t.Fatalf("expect no forwarded request, but got %d", n)
+	}
+}
+
+func TestRemoveStalePeers(t *testing.T) {
+	s, err := NewServer("localhost:9999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := newTestClient(t, s)
+	s.clients = map[string]*client{"localhost:9997": peer, "localhost:9998": newTestClient(t, s)}
+	s.Placement.AddTruthNode("localhost:9999", "localhost:9998", "localhost:9997")
+
+	// 重新监听期间 9997 离开，注册列表中不包含本节点时本节点同样保留在哈希环上
+	if n := s.removeStalePeers([]string{"localhost:9998"}); n != 1 {
+		t.Fatalf("expect 1 stale peer removed, but got %d", n)
+	}
+	if members := s.Placement.Members(); len(members) != 2 || members[0] != "localhost:9998" || members[1] != "localhost:9999" {
+		t.Fatalf("unexpected members %v", members)
+	}
+	if _, ok := s.clients["localhost:9997"]; ok {
+		t.Fatal("expect the connection to the stale peer to be closed")
+	}
+}
@@ -1,25 +1,38 @@
 package singleflight
 
 import (
-	"github.com/1055373165/groupcache/logger"
-	"os"
+	"context"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Call struct {
-	wg    sync.WaitGroup
+	done  chan struct{} // 查询完成后关闭，等待者可以同时监听自己的 ctx
 	value interface{}
 	err   error
+	// waiters 是仍在等待结果的请求数，归零时通过 cancel 取消查询；DoAsync 发起的查询没有 cancel，不会被取消
+	waiters int
+	cancel  context.CancelFunc
 }
 
 type SingleFlight struct {
-	mu sync.Mutex
-	m  map[string]*Call
+	mu   sync.Mutex
+	m    map[string]*Call
+	dups int64 // 等待并共享其他请求查询结果的次数
+}
+
+// Dups 返回等待并共享其他请求查询结果的次数，即被合并掉的查询数
+func (sf *SingleFlight) Dups() int64 {
+	return atomic.LoadInt64(&sf.dups)
 }
 
 // 使用 SingleFlight 对 Group 缓存未命中时的查询进行再封装，并发请求期间只有一个请求会以 goroutine 形式调用查询，
 // 并发查询期间的所有其他请求均阻塞等待，当然我们也可以配置是否允许阻塞，给调用者更多选择
-func (sf *SingleFlight) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+// fn 收到的 ctx 保留了第一个请求 ctx 中的值（例如 trace 信息）和截止时间，但不继承它的取消信号：
+// 任何一个请求的 ctx 先被取消或超时，只有这个请求立即返回 ctx.Err()，其他请求继续等待查询结果；
+// 所有请求都离开之后查询才会被取消，第一个请求的截止时间到达时查询同样结束
+func (sf *SingleFlight) Do(ctx context.Context, key string, fn func(context.Context) (interface{}, error)) (interface{}, error) {
 	// 并发安全，加锁
 	sf.mu.Lock()
 
@@ -29,34 +42,98 @@ func (sf *SingleFlight) Do(key string, fn func() (interface{}, error)) (interfac
 	}
 	// 判断是否已经有 goroutine 在查询了
 	if c, ok := sf.m[key]; ok {
+		c.waiters++
 		// 直接可以释放锁了，让其他并发请求进来
 		sf.mu.Unlock()
+		atomic.AddInt64(&sf.dups, 1)
 		// 等待查询 key 值的 goroutine 阻塞返回
-		Geteuid := os.Geteuid()
-		logger.Logger.Warnf("已经在查询了，阻塞等待 goroutine 返回, 进程号: %d\n", Geteuid)
-		c.wg.Wait()
+		return sf.wait(ctx, key, c)
+	}
+
+	// 没有相同 key 的 goroutine 在查询
+	// 截止时间需要传递给远端节点和数据源，否则它们只能使用各自的默认超时
+	var (
+		fctx   context.Context
+		cancel context.CancelFunc
+	)
+	if deadline, ok := ctx.Deadline(); ok {
+		fctx, cancel = context.WithDeadline(detachedContext{ctx}, deadline)
+	} else {
+		fctx, cancel = context.WithCancel(detachedContext{ctx})
+	}
+	c := &Call{done: make(chan struct{}), waiters: 1, cancel: cancel}
+	sf.m[key] = c
+	// 可以释放锁了，等待者通过 c.done 获知查询结束
+	sf.mu.Unlock()
+
+	// 在独立的 goroutine 中查询，发起查询的请求与其他请求一样等待结果
+	go sf.call(c, key, func() (interface{}, error) { return fn(fctx) })
+	return sf.wait(ctx, key, c)
+}
+
+// wait 等待查询结束，ctx 先结束时离开；最后一个等待者离开时取消查询，
+// 并将查询从字典中移除，之后的请求会重新发起查询而不是得到取消的结果
+func (sf *SingleFlight) wait(ctx context.Context, key string, c *Call) (interface{}, error) {
+	select {
+	case <-c.done:
 		// 用于查询的 goroutine 已经返回，结果值已经存入 Call 结构体中
 		return c.value, c.err
+	case <-ctx.Done():
+		sf.mu.Lock()
+		c.waiters--
+		if c.waiters == 0 && c.cancel != nil {
+			c.cancel()
+			if sf.m[key] == c {
+				delete(sf.m, key)
+			}
+		}
+		sf.mu.Unlock()
+		return nil, ctx.Err()
 	}
+}
 
-	// 没有相同 key 的 goroutine 在查询
-	c := new(Call)
-	// 上锁
+// DoAsync 在后台 goroutine 中执行 fn 并立即返回，key 已经有查询在进行时不会重复执行，返回 false
+// 执行期间对同一个 key 调用 Do 的请求会等待并共享这次的结果
+func (sf *SingleFlight) DoAsync(key string, fn func() (interface{}, error)) bool {
+	sf.mu.Lock()
+	if sf.m == nil {
+		sf.m = make(map[string]*Call)
+	}
+	if _, ok := sf.m[key]; ok {
+		sf.mu.Unlock()
+		return false
+	}
+	c := &Call{done: make(chan struct{})}
 	sf.m[key] = c
-	// 任务编排计数+1
-	c.wg.Add(1)
-	// 可以释放锁了，我们已经上了另一把锁
 	sf.mu.Unlock()
 
-	// 开启查询，c.value 和 c.err 接收返回值
+	go sf.call(c, key, fn)
+	return true
+}
+
+// call 执行查询并唤醒所有等待者，c 需要已经登记在 sf.m 中
+func (sf *SingleFlight) call(c *Call, key string, fn func() (interface{}, error)) {
 	c.value, c.err = fn()
-	// 阻塞等待查询的 goroutine 返回
-	c.wg.Done()
+	if c.cancel != nil {
+		c.cancel()
+	}
+	// 唤醒所有阻塞等待的请求
+	close(c.done)
 	// 阻塞调用返回，我们可以将这个查询从 singleFlight 结构体中删除了，以确保我们总能取到比较新的值
-	// 在对 sf 的字典进行操作时，为了保证并发安全，我们需要上锁
+	// 在对 sf 的字典进行操作时，为了保证并发安全，我们需要上锁；查询被取消后 key 可能已经有了新的查询，不能误删
 	sf.mu.Lock()
-	delete(sf.m, key)
+	if sf.m[key] == c {
+		delete(sf.m, key)
+	}
 	sf.mu.Unlock()
+}
 
-	return c.value, c.err
+// detachedContext 保留 parent 中的值，但不继承它的取消信号和截止时间，截止时间由 Do 重新设置
+type detachedContext struct {
+	parent context.Context
 }
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (d detachedContext) Value(key interface{}) interface{} { return d.parent.Value(key) }
@@ -0,0 +1,118 @@
+package singleflight
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// waitDups 等待 n 个请求加入正在进行的查询
+func waitDups(t *testing.T, sf *SingleFlight, n int64) {
+	for deadline := time.Now().Add(time.Second); sf.Dups() < n; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expect %d waiters, but got %d", n, sf.Dups())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDoLeaderCancel(t *testing.T) {
+	sf := &SingleFlight{}
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		<-release
+		// 发起查询的请求已经离开，但还有请求在等待，查询不应被取消
+		return "value", ctx.Err()
+	}
+
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	leader := make(chan error, 1)
+	go func() {
+		_, err := sf.Do(leaderCtx, "key", fn)
+		leader <- err
+	}()
+	for {
+		sf.mu.Lock()
+		_, started := sf.m["key"]
+		sf.mu.Unlock()
+		if started {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	type result struct {
+		v   interface{}
+		err error
+	}
+	waiter := make(chan result, 1)
+	go func() {
+		v, err := sf.Do(context.Background(), "key", fn)
+		waiter <- result{v, err}
+	}()
+	waitDups(t, sf, 1)
+
+	cancel()
+	if err := <-leader; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expect leader to return context.Canceled, but got %v", err)
+	}
+	close(release)
+	if r := <-waiter; r.err != nil || r.v != "value" {
+		t.Fatalf("expect waiter to get the value, but got %v %v", r.v, r.err)
+	}
+}
+
+func TestDoAllWaitersLeave(t *testing.T) {
+	sf := &SingleFlight{}
+	canceled := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		<-ctx.Done()
+		close(canceled)
+		return nil, ctx.Err()
+	}
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	done := make(chan struct{}, 2)
+	go func() { sf.Do(ctx1, "key", fn); done <- struct{}{} }()
+	go func() { sf.Do(ctx2, "key", fn); done <- struct{}{} }()
+	waitDups(t, sf, 1)
+
+	cancel1()
+	<-done
+	select {
+	case <-canceled:
+		t.Fatal("expect call to keep running while a waiter remains")
+	case <-time.After(20 * time.Millisecond):
+	}
+	cancel2()
+	<-done
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("expect call to be canceled after all waiters left")
+	}
+
+	// 被取消的查询不会被之后的请求共享
+	v, err := sf.Do(context.Background(), "key", func(ctx context.Context) (interface{}, error) {
+		return "fresh", nil
+	})
+	if err != nil || v != "fresh" {
+		t.Fatalf("expect a fresh call, but got %v %v", v, err)
+	}
+}
+
+func TestDoDeadline(t *testing.T) {
+	sf := &SingleFlight{}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	want, _ := ctx.Deadline()
+	v, err := sf.Do(ctx, "key", func(ctx context.Context) (interface{}, error) {
+		deadline, ok := ctx.Deadline()
+		return ok && deadline.Equal(want), nil
+	})
+	if err != nil || v != true {
+		t.Fatal("expect fn to receive the caller's deadline")
+	}
+}
@@ -0,0 +1,17 @@
+package etcd
+
+import "sync/atomic"
+
+// Stats 记录了 Group 处理请求的各项计数，所有字段均可并发读取
+// 缓存本身的容量、条目数与淘汰数见 Group.CacheStats
+type Stats struct {
+	Gets            atomic.Int64 // Get 请求数，GetMulti 中的每个 key 各计一次
+	MainHits        atomic.Int64 // mainCache 命中数
+	HotHits         atomic.Int64 // hotCache 命中数
+	StaleHits       atomic.Int64 // 返回过期旧值的次数（stale-while-revalidate 与 ServeStale）
+	PeerLoads       atomic.Int64 // 从远端节点成功取回的次数
+	PeerErrors      atomic.Int64 // 请求远端节点失败的次数
+	RetrieverLoads  atomic.Int64 // 调用 Retriever 回源的次数，批量回源中的每个 key 各计一次
+	RetrieverErrors atomic.Int64 // Retriever 返回错误的次数，不包括数据不存在
+	ServerRequests  atomic.Int64 // 收到的来自其他节点的请求数
+}
@@ -0,0 +1,128 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// tracing 模块为请求路径加上 OpenTelemetry span，使用全局的 TracerProvider 与 TextMapPropagator
+// 应用通过 otel.SetTracerProvider 与 otel.SetTextMapPropagator 启用，未设置时 span 为空操作
+// trace 上下文通过 gRPC 元数据在节点之间传递，owner 上的 span 与调用方属于同一条 trace
+const tracerName = "github.com/1055373165/groupcache"
+
+// span 属性
+const (
+	attrGroup   = attribute.Key("groupcache.group")
+	attrKeyHash = attribute.Key("groupcache.key_hash")
+	attrPeer    = attribute.Key("groupcache.peer")
+)
+
+// keyAttr 返回 key 的 span 属性，与日志一样只记录 key 的哈希，避免把业务数据发送到 trace 后端
+func keyAttr(key string) attribute.KeyValue {
+	return attrKeyHash.Int64(int64(keyHash(key)))
+}
+
+// startSpan 以 ctx 中的 span 为父节点创建一个新的 span
+func startSpan(ctx context.Context, name string, kind trace.SpanKind, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithSpanKind(kind), trace.WithAttributes(attrs...))
+}
+
+// endSpan 记录错误并结束 span，数据不存在是正常的查询结果，不标记为错误
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		if !errors.Is(err, ErrNotFound) {
+			span.SetStatus(otelcodes.Error, err.Error())
+		}
+	}
+	span.End()
+}
+
+// metadataCarrier 让 TextMapPropagator 可以读写 gRPC 元数据
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if values := metadata.MD(c).Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// injectTrace 将 ctx 中的 trace 上下文写入发往 peer 的 gRPC 元数据
+func injectTrace(ctx context.Context) context.Context {
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if ok {
+		md = md.Copy()
+	} else {
+		md = metadata.MD{}
+	}
+	otel.GetTextMapPropagator().Inject(ctx, metadataCarrier(md))
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// extractTrace 从收到的 gRPC 元数据中还原调用方的 trace 上下文
+func extractTrace(ctx context.Context) context.Context {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
+}
+
+// rpcSpanName 将 gRPC 方法名 /groupcachepb.GroupCache/Get 转换为 span 名称 groupcachepb.GroupCache/Get
+func rpcSpanName(fullMethod string) string {
+	return strings.TrimPrefix(fullMethod, "/")
+}
+
+// traceUnaryServer 是为 unary RPC 创建 server span 的拦截器
+func traceUnaryServer(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	var attrs []attribute.KeyValue
+	if r, ok := req.(interface{ GetGroup() string }); ok {
+		attrs = append(attrs, attrGroup.String(r.GetGroup()))
+	}
+	if r, ok := req.(interface{ GetKey() string }); ok {
+		attrs = append(attrs, keyAttr(r.GetKey()))
+	}
+	ctx, span := startSpan(extractTrace(ctx), rpcSpanName(info.FullMethod), trace.SpanKindServer, attrs...)
+	resp, err := handler(ctx, req)
+	endSpan(span, fromStatus(err))
+	return resp, err
+}
+
+// traceStreamServer 是为 streaming RPC 创建 server span 的拦截器
+func traceStreamServer(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, span := startSpan(extractTrace(ss.Context()), rpcSpanName(info.FullMethod), trace.SpanKindServer)
+	err := handler(srv, &tracedServerStream{ServerStream: ss, ctx: ctx})
+	endSpan(span, fromStatus(err))
+	return err
+}
+
+// tracedServerStream 替换了 ServerStream 的 ctx，使 handler 中创建的 span 挂在 server span 之下
+type tracedServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *tracedServerStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,117 @@
+package etcd
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// ownerFetcher 把请求转发到 owner 上另一个名字的 Group
+// 测试中调用方与 owner 在同一个进程内，使用不同的 Group 模拟两个节点
+type ownerFetcher struct {
+	Fetcher
+	group string
+}
+
+func (f *ownerFetcher) Fetch(ctx context.Context, _ string, key string) (ByteView, error) {
+	return f.Fetcher.Fetch(ctx, f.group, key)
+}
+
+func TestTracingAcrossPeers(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer func() {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	}()
+
+	NewGroup("trace-owner", 2<<10, RetrieveFunc(func(key string) ([]byte, error) {
+		return []byte("630"), nil
+	}))
+	defer DestroryGroup("trace-owner")
+	g := NewGroup("trace", 2<<10, RetrieveFunc(func(key string) ([]byte, error) {
+		t.Fatal("expect key to be retrieved on the owner")
+		return nil, nil
+	}))
+	defer DestroryGroup("trace")
+	s, err := NewServer("localhost:9999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.RegisterServer(&fakePicker{owner: &ownerFetcher{Fetcher: newTestClient(t, s), group: "trace-owner"}})
+
+	if view, err := g.Get(context.Background(), "Tom"); err != nil || view.String() != "630" {
+		t.Fatalf("unexpected result %q %v", view.String(), err)
+	}
+
+	spans := make(map[string][]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = append(spans[span.Name], span)
+	}
+	for name, count := range map[string]int{
+		"groupcache.Group.Get":              2, // 调用方与 owner 各一个
+		"groupcache.singleflight.Do":        2,
+		"groupcache.client.Fetch":           1,
+		"groupcachepb.GroupCache/GetStream": 1,
+		"groupcache.Retriever.retrieve":     1,
+	} {
+		if len(spans[name]) != count {
+			t.Fatalf("expect %d %s spans, but got %d", count, name, len(spans[name]))
+		}
+	}
+
+	// 所有 span 属于同一条 trace，owner 上的 server span 是调用方 client span 的子节点
+	traceID := spans["groupcache.client.Fetch"][0].SpanContext.TraceID()
+	for _, span := range exporter.GetSpans() {
+		if span.SpanContext.TraceID() != traceID {
+			t.Fatalf("span %s belongs to another trace", span.Name)
+		}
+	}
+	server := spans["groupcachepb.GroupCache/GetStream"][0]
+	if server.Parent.SpanID() != spans["groupcache.client.Fetch"][0].SpanContext.SpanID() {
+		t.Fatal("expect server span to be a child of the client span")
+	}
+	if !server.Parent.IsRemote() {
+		t.Fatal("expect server span parent to be propagated through grpc metadata")
+	}
+	retrieve := spans["groupcache.Retriever.retrieve"][0]
+	if retrieve.Parent.TraceID() != traceID {
+		t.Fatal("expect retriever span to be in the caller's trace")
+	}
+
+	// span 只记录 key 的哈希，不记录 key 本身
+	for _, span := range exporter.GetSpans() {
+		for _, attr := range span.Attributes {
+			if attr.Value.Emit() == "Tom" {
+				t.Fatalf("span %s exposes the raw key in %s", span.Name, attr.Key)
+			}
+		}
+	}
+	if attrs := retrieve.Attributes; !hasAttr(attrs, keyAttr("Tom")) {
+		t.Fatalf("expect retriever span to carry the key hash, but got %v", attrs)
+	}
+
+	// Server.Pick 同样会创建 span
+	exporter.Reset()
+	s.Pick(context.Background(), "Tom")
+	if got := exporter.GetSpans(); len(got) != 1 || got[0].Name != "groupcache.Server.Pick" {
+		t.Fatalf("expect a Server.Pick span, but got %v", got)
+	}
+}
+
+// hasAttr 判断 attrs 中是否包含 want
+func hasAttr(attrs []attribute.KeyValue, want attribute.KeyValue) bool {
+	for _, attr := range attrs {
+		if attr == want {
+			return true
+		}
+	}
+	return false
+}